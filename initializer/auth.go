@@ -0,0 +1,255 @@
+package initializer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+)
+
+const (
+	// AuthMethodToken uses the token given by VaultToken or VaultTokenFile as-is
+	AuthMethodToken = "token"
+
+	// AuthMethodAppRole logs in to Vault with an AppRole role_id and secret_id
+	AuthMethodAppRole = "approle"
+
+	// AuthMethodKubernetes logs in to Vault with a Kubernetes service account JWT
+	AuthMethodKubernetes = "kubernetes"
+
+	// AuthMethodJWT logs in to Vault with a JWT read from a file
+	AuthMethodJWT = "jwt"
+
+	// AuthMethodCert logs in to Vault with the TLS client certificate given by
+	// VAULT_CLIENT_CERT and VAULT_CLIENT_KEY
+	AuthMethodCert = "cert"
+)
+
+// validateAuthMethod checks that the settings required by the configured
+// auth method are present.
+func (c *Config) validateAuthMethod() error {
+	switch c.AuthMethod {
+	case AuthMethodToken:
+		return nil
+	case AuthMethodAppRole:
+		if c.AppRoleRoleID == "" && c.AppRoleRoleIDFile == "" {
+			return errors.New("Both AppRoleRoleID and AppRoleRoleIDFile are unset")
+		}
+
+		return nil
+	case AuthMethodKubernetes:
+		if c.KubernetesRole == "" {
+			return errors.New("KubernetesRole is unset")
+		}
+
+		return nil
+	case AuthMethodJWT:
+		if c.JWTFile == "" {
+			return errors.New("JWTFile is unset")
+		}
+
+		if c.JWTRole == "" {
+			return errors.New("JWTRole is unset")
+		}
+
+		return nil
+	case AuthMethodCert:
+		if os.Getenv(vaultApi.EnvVaultClientCert) == "" || os.Getenv(vaultApi.EnvVaultClientKey) == "" {
+			return errors.Errorf("%s and %s must be set", vaultApi.EnvVaultClientCert, vaultApi.EnvVaultClientKey)
+		}
+
+		return nil
+	default:
+		return errors.Errorf("unknown auth method: %s", c.AuthMethod)
+	}
+}
+
+// loginRequest builds the auth mount and login data for the configured auth
+// method. Credentials stored in files are read on every call so that rotated
+// files are picked up when logging in again.
+func (c *Config) loginRequest() (string, map[string]interface{}, error) {
+	switch c.AuthMethod {
+	case AuthMethodAppRole:
+		roleID, err := readCredential(c.AppRoleRoleID, c.AppRoleRoleIDFile)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "could not read AppRole role ID")
+		}
+
+		secretID, err := readCredential(c.AppRoleSecretID, c.AppRoleSecretIDFile)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "could not read AppRole secret ID")
+		}
+
+		data := map[string]interface{}{
+			"role_id": roleID,
+		}
+
+		if secretID != "" {
+			data["secret_id"] = secretID
+		}
+
+		return c.AppRoleMount, data, nil
+	case AuthMethodKubernetes:
+		jwt, err := readCredential("", c.KubernetesTokenFile)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "could not read Kubernetes service account token")
+		}
+
+		data := map[string]interface{}{
+			"jwt":  jwt,
+			"role": c.KubernetesRole,
+		}
+
+		return c.KubernetesMount, data, nil
+	case AuthMethodJWT:
+		jwt, err := readCredential("", c.JWTFile)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "could not read JWT")
+		}
+
+		data := map[string]interface{}{
+			"jwt":  jwt,
+			"role": c.JWTRole,
+		}
+
+		return c.JWTMount, data, nil
+	case AuthMethodCert:
+		// The certificate itself is presented by the TLS transport, so the
+		// only login data is the optional role name
+		data := map[string]interface{}{}
+		if c.CertRole != "" {
+			data["name"] = c.CertRole
+		}
+
+		return c.CertMount, data, nil
+	default:
+		return "", nil, errors.Errorf("auth method `%s` does not support logging in", c.AuthMethod)
+	}
+}
+
+// authenticate logs vault-init in to Vault with the configured auth method and
+// switches the Vault client over to the resulting token. Returns nil when the
+// token auth method is in use, as there is nothing to log in with.
+func authenticate(vaultClient vaultclient.VaultClient, config *Config) (*vaultApi.Secret, error) {
+	if config.AuthMethod == AuthMethodToken {
+		return nil, nil
+	}
+
+	mount, data, err := config.loginRequest()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not build login request")
+	}
+
+	log.WithField("mount", mount).Infof("Logging in to Vault with auth method `%s`", config.AuthMethod)
+	loginSecret, err := vaultClient.Login(mount, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not log in with auth method `%s`", config.AuthMethod)
+	}
+
+	if err := vaultClient.SetToken(loginSecret.Auth.ClientToken); err != nil {
+		return nil, errors.Wrap(err, "could not use token returned by login")
+	}
+
+	log.WithField("accessor_id", loginSecret.Auth.Accessor).Debugf("Logged in to Vault")
+	return loginSecret, nil
+}
+
+// unwrapBootstrapToken checks whether VaultToken is a response-wrapping token and,
+// if so, unwraps it. A wrapped token replaces VaultToken, while a wrapped AppRole
+// secret_id is used for the AppRole login. A token that is neither a valid
+// wrapping token nor a valid token may be a wrapping token that was already
+// used, and is warned about. If UnwrapToken is set, any token that is not a
+// valid wrapping token is refused.
+func unwrapBootstrapToken(vaultClient vaultclient.VaultClient, config *Config) error {
+	if config.VaultToken == "" {
+		if *config.UnwrapToken {
+			return errors.New("UnwrapToken is set, but there is no VaultToken to unwrap")
+		}
+
+		return nil
+	}
+
+	lookup, err := vaultClient.LookupWrappingToken(config.VaultToken)
+	if err != nil {
+		return errors.Wrap(err, "could not check whether VaultToken is a wrapping token")
+	}
+
+	if lookup == nil {
+		if *config.UnwrapToken {
+			log.Errorf("SECURITY WARNING: VaultToken is not a valid response-wrapping token. " +
+				"It may have already been unwrapped by someone who intercepted it; refusing to start!")
+			return errors.New("wrapping token is invalid or was already used")
+		}
+
+		self, err := vaultClient.LookupToken(config.VaultToken)
+		if err != nil {
+			return errors.Wrap(err, "could not check whether VaultToken is valid")
+		}
+
+		if self == nil {
+			log.Errorf("SECURITY WARNING: VaultToken is neither a valid token nor a valid response-wrapping token. " +
+				"If it was a wrapping token, it may have already been unwrapped by someone who intercepted it!")
+			return nil
+		}
+
+		log.Debugf("VaultToken is not a response-wrapping token")
+		return nil
+	}
+
+	log.WithField("creation_path", lookup.Data["creation_path"]).Infof("Unwrapping response-wrapped bootstrap token")
+	unwrapped, err := vaultClient.Unwrap(config.VaultToken)
+	if err != nil {
+		log.Errorf("SECURITY WARNING: Could not unwrap the response-wrapping token after looking it up. " +
+			"It may have been unwrapped by someone who intercepted it; refusing to start!")
+		return errors.Wrap(err, "could not unwrap bootstrap token")
+	}
+
+	// Tokens wrapped with `sys/wrapping/wrap`, such as the child tokens
+	// handed out with ChildTokenWrapTTL, are held in the wrapped data
+	token, _ := unwrapped.Data["token"].(string)
+	if unwrapped.Auth != nil && unwrapped.Auth.ClientToken != "" {
+		token = unwrapped.Auth.ClientToken
+	}
+
+	if token != "" {
+		config.VaultToken = token
+		os.Setenv(vaultApi.EnvVaultToken, config.VaultToken)
+
+		return vaultClient.SetToken(config.VaultToken)
+	}
+
+	if secretID, ok := unwrapped.Data["secret_id"].(string); ok && secretID != "" {
+		if config.AuthMethod != AuthMethodAppRole {
+			return errors.Errorf("wrapping token contained an AppRole secret ID, but the auth method is `%s`", config.AuthMethod)
+		}
+
+		config.AppRoleSecretID = secretID
+
+		// The used wrapping token is no longer valid, so stop sending it along
+		config.VaultToken = ""
+		os.Unsetenv(vaultApi.EnvVaultToken)
+
+		return vaultClient.SetToken("")
+	}
+
+	return errors.New("wrapped response contains neither a token nor an AppRole secret ID")
+}
+
+// readCredential returns value if it is set, otherwise the trimmed contents
+// of the file at path. Returns an empty string if neither is set.
+func readCredential(value, path string) (string, error) {
+	if value != "" || path == "" {
+		return value, nil
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "could not read credential file: %s", path)
+	}
+
+	return strings.TrimSpace(string(contents)), nil
+}
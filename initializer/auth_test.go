@@ -0,0 +1,310 @@
+package initializer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	vaultApi "github.com/hashicorp/vault/api"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient/dummy"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient/real"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func TestAppRoleLoginRequest(t *testing.T) {
+	dir := t.TempDir()
+
+	secretIDFile := filepath.Join(dir, "secret_id")
+	if err := ioutil.WriteFile(secretIDFile, []byte("my-secret-id\n"), 0600); err != nil {
+		t.Fatalf("could not write secret id file: %v", err)
+	}
+
+	cfg := &Config{
+		AuthMethod:          AuthMethodAppRole,
+		AppRoleMount:        "approle",
+		AppRoleRoleID:       "my-role-id",
+		AppRoleSecretIDFile: secretIDFile,
+	}
+
+	mount, data, err := cfg.loginRequest()
+	if err != nil {
+		t.Fatalf("unexpected error building login request: %v", err)
+	}
+
+	if mount != "approle" {
+		t.Errorf("expected mount to be 'approle', got: %s", mount)
+	}
+
+	if data["role_id"] != "my-role-id" {
+		t.Errorf("expected role_id to be 'my-role-id', got: %v", data["role_id"])
+	}
+
+	if data["secret_id"] != "my-secret-id" {
+		t.Errorf("expected secret_id to be 'my-secret-id', got: %v", data["secret_id"])
+	}
+}
+
+func TestAppRoleValidation(t *testing.T) {
+	cfg := &Config{
+		AuthMethod: AuthMethodAppRole,
+	}
+
+	if err := cfg.ValidateAndSetDefaults(); err == nil {
+		t.Errorf("expected error validating AppRole config without a role ID")
+	}
+
+	cfg.AppRoleRoleID = "my-role-id"
+	if err := cfg.ValidateAndSetDefaults(); err != nil {
+		t.Errorf("unexpected error validating AppRole config without a Vault token: %v", err)
+	}
+}
+
+func TestAuthenticateWithDummyClient(t *testing.T) {
+	cfg := &Config{
+		AuthMethod:    AuthMethodAppRole,
+		AppRoleMount:  "approle",
+		AppRoleRoleID: "my-role-id",
+	}
+
+	client, _ := dummy.NewClient(vaultclient.NewConfigWithDefaults())
+
+	loginSecret, err := authenticate(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error authenticating: %v", err)
+	}
+
+	if loginSecret == nil || loginSecret.Auth.ClientToken != "dummy-token-approle" {
+		t.Errorf("expected login to return the dummy client's token, got: %#v", loginSecret)
+	}
+}
+
+func TestKubernetesLoginAgainstTestServer(t *testing.T) {
+	dir := t.TempDir()
+
+	jwtFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(jwtFile, []byte("service-account-jwt"), 0600); err != nil {
+		t.Fatalf("could not write service account token file: %v", err)
+	}
+
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/auth/kubernetes/login", http.StatusOK, `{"auth": {"client_token": "k8s-token", "accessor": "k8s-accessor", "renewable": true}}`)
+
+	cfg := &Config{
+		AuthMethod:          AuthMethodKubernetes,
+		KubernetesMount:     "kubernetes",
+		KubernetesRole:      "my-service",
+		KubernetesTokenFile: jwtFile,
+	}
+
+	client, err := real.NewClient(server.Config())
+	if err != nil {
+		t.Fatalf("could not create Vault client: %v", err)
+	}
+
+	loginSecret, err := authenticate(client, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error authenticating: %v", err)
+	}
+
+	if loginSecret.Auth.ClientToken != "k8s-token" {
+		t.Errorf("expected client token 'k8s-token', got: %s", loginSecret.Auth.ClientToken)
+	}
+
+	logins := server.Requests("/v1/auth/kubernetes/login")
+	if len(logins) != 1 || logins[0].Body["jwt"] != "service-account-jwt" || logins[0].Body["role"] != "my-service" {
+		t.Errorf("expected a single login with service account JWT and role, got: %v", logins)
+	}
+}
+
+func TestJWTLoginRequestRereadsFile(t *testing.T) {
+	dir := t.TempDir()
+
+	jwtFile := filepath.Join(dir, "jwt")
+	cfg := &Config{
+		AuthMethod: AuthMethodJWT,
+		JWTFile:    jwtFile,
+		JWTMount:   "jwt",
+		JWTRole:    "my-service",
+	}
+
+	for _, jwt := range []string{"first-jwt", "rotated-jwt"} {
+		if err := ioutil.WriteFile(jwtFile, []byte(jwt), 0600); err != nil {
+			t.Fatalf("could not write JWT file: %v", err)
+		}
+
+		_, data, err := cfg.loginRequest()
+		if err != nil {
+			t.Fatalf("unexpected error building login request: %v", err)
+		}
+
+		if data["jwt"] != jwt {
+			t.Errorf("expected jwt to be '%s', got: %v", jwt, data["jwt"])
+		}
+	}
+}
+
+func TestCertLoginRequest(t *testing.T) {
+	cases := []struct {
+		certRole string
+		data     map[string]interface{}
+	}{
+		{"", map[string]interface{}{}},
+		{"web", map[string]interface{}{"name": "web"}},
+	}
+
+	for _, c := range cases {
+		cfg := &Config{
+			AuthMethod: AuthMethodCert,
+			CertMount:  "cert",
+			CertRole:   c.certRole,
+		}
+
+		mount, data, err := cfg.loginRequest()
+		if err != nil {
+			t.Fatalf("unexpected error building login request: %v", err)
+		}
+
+		if mount != "cert" {
+			t.Errorf("expected mount to be 'cert', got: %s", mount)
+		}
+
+		if !reflect.DeepEqual(data, c.data) {
+			t.Errorf("expected login data %v with role '%s', got: %v", c.data, c.certRole, data)
+		}
+	}
+}
+
+func TestCertValidation(t *testing.T) {
+	defer os.Unsetenv(vaultApi.EnvVaultClientCert)
+	defer os.Unsetenv(vaultApi.EnvVaultClientKey)
+
+	os.Unsetenv(vaultApi.EnvVaultClientCert)
+	os.Unsetenv(vaultApi.EnvVaultClientKey)
+
+	cfg := &Config{
+		AuthMethod: AuthMethodCert,
+	}
+
+	if err := cfg.ValidateAndSetDefaults(); err == nil {
+		t.Errorf("expected error validating cert config without a client certificate and key")
+	}
+
+	os.Setenv(vaultApi.EnvVaultClientCert, "/etc/vault-init/client.pem")
+	if err := cfg.ValidateAndSetDefaults(); err == nil {
+		t.Errorf("expected error validating cert config without a client key")
+	}
+
+	os.Setenv(vaultApi.EnvVaultClientKey, "/etc/vault-init/client-key.pem")
+	if err := cfg.ValidateAndSetDefaults(); err != nil {
+		t.Errorf("unexpected error validating cert config without a Vault token: %v", err)
+	}
+}
+
+// newUnwrapTestClient creates a client against a fake Vault, whose wrapping
+// token unwraps to the given response and can only be used once.
+func newUnwrapTestClient(t *testing.T, unwrapResponse string) vaultclient.VaultClient {
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/sys/wrapping/unwrap", http.StatusOK, unwrapResponse)
+	server.Handle("/v1/sys/wrapping/lookup", func(w http.ResponseWriter, r *vaulttest.Request) {
+		if len(server.Requests("/v1/sys/wrapping/unwrap")) > 0 {
+			vaulttest.Error(w, http.StatusBadRequest, "wrapping token is not valid or does not exist")
+			return
+		}
+
+		fmt.Fprint(w, `{"data": {"creation_path": "auth/token/create", "creation_ttl": 60}}`)
+	})
+
+	client, err := real.NewClient(server.Config())
+	if err != nil {
+		t.Fatalf("could not create Vault client: %v", err)
+	}
+
+	return client
+}
+
+func TestUnwrapBootstrapToken(t *testing.T) {
+	client := newUnwrapTestClient(t, `{"auth": {"client_token": "unwrapped-token", "accessor": "unwrapped-accessor"}}`)
+
+	// Unwrapping a token exports it as VAULT_TOKEN
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	unwrapToken := true
+	cfg := &Config{
+		AuthMethod:  AuthMethodToken,
+		UnwrapToken: &unwrapToken,
+		VaultToken:  "wrapping-token",
+	}
+
+	if err := unwrapBootstrapToken(client, cfg); err != nil {
+		t.Fatalf("unexpected error unwrapping bootstrap token: %v", err)
+	}
+
+	if cfg.VaultToken != "unwrapped-token" {
+		t.Errorf("expected VaultToken to be 'unwrapped-token', got: %s", cfg.VaultToken)
+	}
+
+	// Unwrapping the same wrapping token again must be refused
+	cfg.VaultToken = "wrapping-token"
+	if err := unwrapBootstrapToken(client, cfg); err == nil {
+		t.Errorf("expected error when the wrapping token was already used")
+	}
+}
+
+func TestUnwrapBootstrapTokenFromWrappedData(t *testing.T) {
+	// sys/wrapping/wrap, as used for ChildTokenWrapTTL, wraps the token as data
+	client := newUnwrapTestClient(t, `{"data": {"token": "wrapped-data-token"}}`)
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	unwrapToken := true
+	cfg := &Config{
+		AuthMethod:  AuthMethodToken,
+		UnwrapToken: &unwrapToken,
+		VaultToken:  "wrapping-token",
+	}
+
+	if err := unwrapBootstrapToken(client, cfg); err != nil {
+		t.Fatalf("unexpected error unwrapping bootstrap token: %v", err)
+	}
+
+	if cfg.VaultToken != "wrapped-data-token" || os.Getenv("VAULT_TOKEN") != "wrapped-data-token" {
+		t.Errorf("expected VaultToken to be 'wrapped-data-token', got: %s", cfg.VaultToken)
+	}
+}
+
+func TestUnwrapBootstrapTokenChecksUsedTokenWithoutUnwrapToken(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/sys/wrapping/lookup", http.StatusBadRequest, `{"errors": ["wrapping token is not valid or does not exist"]}`)
+	server.Respond("/v1/auth/token/lookup-self", http.StatusForbidden, `{"errors": ["permission denied"]}`)
+
+	client, err := real.NewClient(server.Config())
+	if err != nil {
+		t.Fatalf("could not create Vault client: %v", err)
+	}
+
+	unwrapToken := false
+	cfg := &Config{
+		AuthMethod:  AuthMethodToken,
+		UnwrapToken: &unwrapToken,
+		VaultToken:  "used-wrapping-token",
+	}
+
+	// Without UnwrapToken, an invalid token is only warned about and fails
+	// once it is used
+	if err := unwrapBootstrapToken(client, cfg); err != nil {
+		t.Fatalf("unexpected error checking used wrapping token: %v", err)
+	}
+
+	if lookedUp := server.Requests("/v1/auth/token/lookup-self").Tokens(); len(lookedUp) != 1 || lookedUp[0] != "used-wrapping-token" {
+		t.Errorf("expected VaultToken to be looked up with itself, got: %v", lookedUp)
+	}
+
+	if cfg.VaultToken != "used-wrapping-token" {
+		t.Errorf("expected VaultToken to be left unchanged, got: %s", cfg.VaultToken)
+	}
+}
@@ -0,0 +1,67 @@
+package initializer
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+)
+
+// bootstrap authenticates to Vault, creates the child token and starts the
+// secret watcher. Steps that succeeded are not repeated when it is retried: a
+// bootstrap wrapping token can only be unwrapped once, so the credential it
+// held is kept in the config, and starting the token manager twice would
+// create a second child token.
+type bootstrap struct {
+	client vaultclient.VaultClient
+	config *Config
+	tokens *tokenManager
+
+	unwrapped     bool
+	tokensStarted bool
+}
+
+func newBootstrap(client vaultclient.VaultClient, config *Config, tokens *tokenManager) *bootstrap {
+	return &bootstrap{
+		client: client,
+		config: config,
+		tokens: tokens,
+	}
+}
+
+// start runs the remaining bootstrap steps and returns the watcher's update
+// channel.
+func (b *bootstrap) start(ctx context.Context) (chan []string, error) {
+	// Unwrap the bootstrap credential if VaultToken is a response-wrapping token
+	if !b.unwrapped {
+		if err := unwrapBootstrapToken(b.client, b.config); err != nil {
+			return nil, errors.Wrap(err, "could not unwrap bootstrap token")
+		}
+
+		b.unwrapped = true
+	}
+
+	// Log in with the configured auth method, create the child token and
+	// downgrade the Vault client to use it
+	if !b.tokensStarted {
+		if err := b.tokens.Start(); err != nil {
+			return nil, errors.Wrap(err, "could not set up Vault tokens")
+		}
+
+		b.tokensStarted = true
+	}
+
+	// Start the secret watcher
+	log.WithField("paths", b.config.Paths).Debugf("Starting secrets watcher")
+	updateCh, err := b.client.StartWatcher(ctx, *b.config.RefreshDuration)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not start secrets watcher")
+	}
+
+	// Keep vault-init's own token and the child token alive, replacing
+	// them when they can no longer be renewed
+	go b.tokens.Watch(ctx, *b.config.RefreshDuration)
+
+	return updateCh, nil
+}
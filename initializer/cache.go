@@ -0,0 +1,132 @@
+package initializer
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/template"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+)
+
+// cachedStart runs the child with the environment rendered from the cached
+// template context while Vault is unreachable. Vault is retried on every
+// refresh; once it answers, vault-init starts as usual and the watcher's
+// updates are forwarded to the supervisor.
+type cachedStart struct {
+	client    vaultclient.VaultClient
+	config    *Config
+	bootstrap *bootstrap
+
+	// environ is the environment rendered from the cached context
+	environ []string
+
+	updateCh  chan []string
+	requestCh chan struct{}
+}
+
+// startFromCache renders the cached template context and sends it as the
+// initial update, then keeps trying to reach Vault in the background. Failing
+// to log in or to create the child token is retried as well, while the child
+// keeps running with the cached environment.
+func startFromCache(ctx context.Context, client vaultclient.VaultClient, config *Config, tokens *tokenManager) (*cachedStart, error) {
+	cached, err := client.GetConfig().ContextCache.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load cached template context")
+	}
+
+	// Values passed to `decrypt` are taken from the cache as well, as
+	// Vault's transit engine can not be reached either
+	environ, err := template.RenderEnvironmentFromCache(client, cached.Context, cached.Plaintexts)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not render cached template context")
+	}
+
+	// VAULT_TOKEN still holds vault-init's own token, which is only replaced
+	// by the child token once Vault is reachable
+	delete(environ, vaultApi.EnvVaultToken)
+
+	start := &cachedStart{
+		client:    client,
+		config:    config,
+		bootstrap: newBootstrap(client, config, tokens),
+		environ:   make([]string, 0, len(environ)),
+		updateCh:  make(chan []string, 1),
+		requestCh: make(chan struct{}, 1),
+	}
+
+	for key, value := range environ {
+		start.environ = append(start.environ, strings.Join([]string{key, value}, "="))
+	}
+
+	log.WithField("savedAt", cached.SavedAt.Format(time.RFC3339)).Warnf("Starting from cached template context until Vault is reachable")
+	start.updateCh <- start.environ
+
+	go start.run(ctx)
+
+	return start, nil
+}
+
+// RequestUpdate asks for the environment to be sent again. Until the watcher
+// has taken over, the cached environment is sent.
+func (s *cachedStart) RequestUpdate() error {
+	if err := s.client.RequestUpdate(); err == nil {
+		return nil
+	}
+
+	select {
+	case s.requestCh <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// run waits for Vault to become reachable, starts vault-init as usual and
+// forwards the watcher's updates until the context is done.
+func (s *cachedStart) run(ctx context.Context) {
+	var watcherCh chan []string
+
+	for watcherCh == nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.requestCh:
+			s.send(ctx, s.environ)
+		case <-time.After(*s.config.RefreshDuration):
+			if err := s.client.Check(); err != nil {
+				log.WithError(err).Warnf("Vault is still unreachable; keeping the cached template context")
+				continue
+			}
+
+			log.Infof("Vault is reachable again; replacing the cached template context")
+
+			var err error
+			watcherCh, err = s.bootstrap.start(ctx)
+			if err != nil {
+				log.WithError(err).Errorf("Could not start after Vault became reachable; keeping the cached template context")
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case environ := <-watcherCh:
+			s.send(ctx, environ)
+		}
+	}
+}
+
+// send passes an environment on to the supervisor, unless vault-init is
+// shutting down.
+func (s *cachedStart) send(ctx context.Context, environ []string) {
+	select {
+	case <-ctx.Done():
+	case s.updateCh <- environ:
+	}
+}
@@ -0,0 +1,154 @@
+package initializer
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/cache"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient/real"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func receiveEnviron(t *testing.T, updateCh chan []string) map[string]bool {
+	select {
+	case environ := <-updateCh:
+		vars := make(map[string]bool, len(environ))
+		for _, envVar := range environ {
+			vars[envVar] = true
+		}
+
+		return vars
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for environment update")
+	}
+
+	return nil
+}
+
+// startTestFromCache starts from a cached context holding `.secret.password`,
+// which is rendered into TEST_CACHED_PASSWORD.
+func startTestFromCache(t *testing.T, ctx context.Context, server *vaulttest.Server, paths []string) *cachedStart {
+	var err error
+	vaultCfg := server.Config()
+	vaultCfg.KVRaw = true
+	vaultCfg.Paths = paths
+	vaultCfg.ContextCache, err = cache.New(filepath.Join(t.TempDir(), "context.cache"), []byte("cache-key"), time.Hour)
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+
+	if err := vaultCfg.ContextCache.Save(map[string]interface{}{"secret": map[string]interface{}{"password": "cached"}}, nil); err != nil {
+		t.Fatalf("could not save cache: %v", err)
+	}
+
+	os.Setenv("TEST_CACHED_PASSWORD", "{{ .secret.password }}")
+	t.Cleanup(func() { os.Unsetenv("TEST_CACHED_PASSWORD") })
+
+	// Set by ValidateAndSetDefaults from VaultToken
+	os.Setenv("VAULT_TOKEN", "parent-token")
+
+	client, err := real.NewClient(vaultCfg)
+	if err != nil {
+		t.Fatalf("could not create Vault client: %v", err)
+	}
+
+	refreshDuration := 10 * time.Millisecond
+	unwrapToken := false
+	cfg := &Config{
+		AuthMethod:      AuthMethodToken,
+		Paths:           paths,
+		RefreshDuration: &refreshDuration,
+		UnwrapToken:     &unwrapToken,
+		VaultToken:      "parent-token",
+	}
+
+	start, err := startFromCache(ctx, client, cfg, newTokenManager(client, cfg, "test"))
+	if err != nil {
+		t.Fatalf("unexpected error starting from cache: %v", err)
+	}
+
+	return start
+}
+
+func TestStartFromCacheHandsOverToVault(t *testing.T) {
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	// Vault fails its health check until it is brought back up, and then
+	// fails to create the first child token
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	server.SetDown(true)
+	server.Fail("/v1/auth/token/create", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := startTestFromCache(t, ctx, server, nil)
+	if err := start.client.Check(); err == nil {
+		t.Fatalf("expected health check to fail while Vault is down")
+	}
+
+	vars := receiveEnviron(t, start.updateCh)
+	if !vars["TEST_CACHED_PASSWORD=cached"] {
+		t.Errorf("expected initial environment to be rendered from the cached context, got: %v", vars)
+	}
+
+	for envVar := range vars {
+		if strings.HasPrefix(envVar, "VAULT_TOKEN=") {
+			t.Errorf("expected vault-init's own token not to be passed to the child, got: %s", envVar)
+		}
+	}
+
+	if err := start.RequestUpdate(); err != nil {
+		t.Fatalf("unexpected error requesting update: %v", err)
+	}
+
+	if vars := receiveEnviron(t, start.updateCh); !vars["TEST_CACHED_PASSWORD=cached"] {
+		t.Errorf("expected cached environment to be sent again while Vault is down, got: %v", vars)
+	}
+
+	server.SetDown(false)
+
+	if vars := receiveEnviron(t, start.updateCh); vars["TEST_CACHED_PASSWORD=cached"] {
+		t.Errorf("expected environment from Vault once it is reachable, got: %v", vars)
+	}
+
+	if created := server.Requests("/v1/auth/token/create"); len(created) != 2 {
+		t.Errorf("expected the child token to be created by retrying after the failed attempt, got %d attempts", len(created))
+	}
+}
+
+func TestStartFromCacheRetriesFailedWatcherStart(t *testing.T) {
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	// Vault is reachable, but fails the initial fetch of the secrets
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	server.Respond("/v1/secret", http.StatusOK, `{"data": {"password": "fresh"}}`)
+	server.Fail("/v1/secret", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	start := startTestFromCache(t, ctx, server, []string{"secret"})
+	if vars := receiveEnviron(t, start.updateCh); !vars["TEST_CACHED_PASSWORD=cached"] {
+		t.Errorf("expected initial environment to be rendered from the cached context, got: %v", vars)
+	}
+
+	if vars := receiveEnviron(t, start.updateCh); !vars["TEST_CACHED_PASSWORD=fresh"] {
+		t.Errorf("expected environment from Vault once the watcher started, got: %v", vars)
+	}
+
+	if fetched := server.Requests("/v1/secret"); len(fetched) != 2 {
+		t.Errorf("expected the secrets to be fetched again after the failed attempt, got %d attempts", len(fetched))
+	}
+
+	if created := server.Requests("/v1/auth/token/create"); len(created) != 1 {
+		t.Errorf("expected the child token not to be created again, got %d attempts", len(created))
+	}
+}
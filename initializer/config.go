@@ -3,29 +3,52 @@ package initializer
 import (
 	"fmt"
 	"os"
-	"strings"
+	"strconv"
 	"time"
 
 	vaultApi "github.com/hashicorp/vault/api"
 	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
 )
 
 const (
+	defaultAppRoleMount              string = "approle"
+	defaultAuthMethod                string = AuthMethodToken
+	defaultCacheMaxStaleness         string = "24h"
+	defaultCertMount                 string = "cert"
+	defaultCollisionPolicy           string = string(secret.CollisionFirstWins)
+	defaultContextNesting            string = string(secret.NestingFullPath)
 	defaultDebug                     bool   = false
+	defaultJWTMount                  string = "jwt"
+	defaultKubernetesMount           string = "kubernetes"
+	defaultKubernetesTokenFile       string = "/var/run/secrets/kubernetes.io/serviceaccount/token"
 	defaultDisableTokenRenew         bool   = false
+	defaultKVRaw                     bool   = false
+	defaultLeaseRevokeGrace          string = "1m"
 	defaultLogFormat                 string = "default"
 	defaultNoInheritToken            bool   = false
 	defaultNoReaper                  bool   = false
 	defaultOneShot                   bool   = false
 	defaultOrphanToken               bool   = false
+	defaultPKIRenewFraction          string = "0.7"
 	defaultRefreshDuration           string = "15s"
 	defaultTelemetryCollectorGolang  bool   = false
 	defaultTelemetryCollectorProcess bool   = false
 	defaultTokenPeriod               string = ""
 	defaultTokenTTL                  string = ""
+	defaultTransitMount              string = "transit"
+	defaultUnwrapToken               bool   = false
 	defaultVerbose                   bool   = false
 )
 
+// defaultTokenMetadata is attached to every child token, unless overridden
+// by a TokenMetadata entry with the same key.
+var defaultTokenMetadata = []string{
+	"hostname={{.Hostname}}",
+	"container_id={{.ContainerID}}",
+}
+
 // Config is the configuration for `vault-init` as a whole
 // and can be populated by an embedding application or populated
 // with arguments from the command line and/or environment variables.
@@ -33,25 +56,66 @@ type Config struct {
 	Command []string `arg:"positional"`
 
 	AccessPolicies    []string       `arg:"-A,--access-policy,separate,env:INIT_ACCESS_POLICIES" help:"Access policies to create Vault token with"`
+	AuthMethod        string         `arg:"--auth-method,env:INIT_AUTH_METHOD" help:"Method vault-init uses to authenticate to Vault [token, approle, kubernetes, jwt, cert]"`
+	ChildTokenFile    string         `arg:"--child-token-file,env:INIT_CHILD_TOKEN_FILE" help:"File to write the child token to; holds the wrapped token if --child-token-wrap-ttl is set"`
+	ChildTokenWrapTTL string         `arg:"--child-token-wrap-ttl,env:INIT_CHILD_TOKEN_WRAP_TTL" help:"Give the child a response-wrapping token with this TTL instead of the raw child token"`
+	CollisionPolicy   string         `arg:"--collision-policy,env:INIT_COLLISION_POLICY" help:"What to do when secrets set the same template context key [error, first-wins, last-wins]"`
+	ContextNesting    string         `arg:"--context-nesting,env:INIT_CONTEXT_NESTING" help:"How secrets are nested in the template context [full-path, shared-ancestry]"`
 	Debug             *bool          `arg:"-D,--debug,env:INIT_DEBUG" help:"Enable super verbose debugging output, which may print sensitive data to terminal"`
 	DisableTokenRenew *bool          `arg:"--disable-token-renew,env:INIT_DISABLE_TOKEN_RENEW" help:"Make the child token unable to be renewed"`
+	KVRaw             *bool          `arg:"--kv-raw,env:INIT_KV_RAW" help:"Do not detect KV v2 mounts; read paths as written and keep the data/metadata nesting of KV v2 secrets"`
+	LeaseRevokeGrace  *time.Duration `arg:"--lease-revoke-grace,env:INIT_LEASE_REVOKE_GRACE" help:"How long the previous lease of a re-fetched dynamic secret, or a replaced child token, stays valid before it is revoked"`
 	LogFormat         string         `arg:"--log-format,env:INIT_LOG_FORMAT" help:"Change the format used for logging [default, plain, json]"`
+	Namespace         string         `arg:"--namespace,env:VAULT_NAMESPACE" help:"Vault Enterprise namespace to use; per-path namespaces in --path as namespace::path are relative to it"`
 	NoInheritToken    *bool          `arg:"--no-inherit-token,env:INIT_NO_INHERIT_TOKEN" help:"Should the created token be passed down to the spawned child"`
 	NoReaper          *bool          `arg:"--without-reaper,env:INIT_NO_REAPER" help:"Disable the subprocess reaper"`
 	OneShot           *bool          `arg:"-O,--one-shot,env:INIT_ONE_SHOT" help:"Do not restart when the child process exits"`
 	OrphanToken       *bool          `arg:"--orphan-token,env:INIT_ORPHAN_TOKEN" help:"Should the created token be independent of the parent"`
+	PKIRenewFraction  *float64       `arg:"--pki-renew-fraction,env:INIT_PKI_RENEW_FRACTION" help:"Fraction of an issued certificate's lifetime after which it is issued again"`
 	Paths             []string       `arg:"-p,--path,separate,env:INIT_PATHS" help:"Secret path to load into template context"`
 	RefreshDuration   *time.Duration `arg:"--refresh-duration,env:INIT_REFRESH_DURATION" help:"How frequently secrets should be checked for version changes"`
 
 	// TokenPeriod will cause the child token to be created as a periodic token:
 	// https://www.vaultproject.io/docs/concepts/tokens.html#periodic-tokens
 	TokenPeriod    string `arg:"--token-period,env:INIT_TOKEN_PERIOD" help:"Renewal period of the child token; creates a periodic token"`
+	TokenRole      string `arg:"--token-role,env:INIT_TOKEN_ROLE" help:"Token role to create the child token with; the role controls policies, TTLs, orphaning and bound CIDRs"`
 	TokenTTL       string `arg:"--token-ttl,env:INIT_TOKEN_TTL" help:"TTL of the token, maximum suffix is hour"`
+	TransitMount   string `arg:"--transit-mount,env:INIT_TRANSIT_MOUNT" help:"Mount path of the transit secrets engine used by the decrypt template function"`
+	UnwrapToken    *bool  `arg:"--unwrap-token,env:INIT_UNWRAP_TOKEN" help:"Require VaultToken to be a response-wrapping token; refuse to start if it was already unwrapped. Without it, an already-used wrapping token is only warned about"`
 	VaultAddress   string `arg:"--vault-address,env:VAULT_ADDR" help:"Address to use to connect to Vault"`
 	VaultToken     string `arg:"--vault-token,env:VAULT_TOKEN" help:"Token to use to authenticate to Vault"`
 	VaultTokenFile string `arg:"--vault-token-file,env:VAULT_TOKEN_FILE" help:"File containing token to use to authenticate to Vault"`
 	Verbose        *bool  `arg:"-v,--verbose,env:INIT_VERBOSE" help:"Enable verbose debug logging"`
 
+	TokenBoundCIDRs     []string `arg:"--token-bound-cidr,separate,env:INIT_TOKEN_BOUND_CIDRS" help:"CIDR block the child token may be used from"`
+	TokenEntityAlias    string   `arg:"--token-entity-alias,env:INIT_TOKEN_ENTITY_ALIAS" help:"Entity alias to associate the child token with; requires --token-role"`
+	TokenExplicitMaxTTL string   `arg:"--token-explicit-max-ttl,env:INIT_TOKEN_EXPLICIT_MAX_TTL" help:"Hard limit on the child token's lifetime, which renewals can not extend"`
+	TokenMetadata       []string `arg:"--token-metadata,separate,env:INIT_TOKEN_METADATA" help:"Metadata to attach to the child token as key=value; values are templates with .Hostname, .ContainerID and .Command"`
+	TokenNumUses        int      `arg:"--token-num-uses,env:INIT_TOKEN_NUM_USES" help:"Number of uses allowed for the token handed to the child, which is separate from the token vault-init uses; unlimited if zero"`
+	TokenType           string   `arg:"--token-type,env:INIT_TOKEN_TYPE" help:"Type of the child token [service, batch]"`
+
+	AppRoleMount        string `arg:"--approle-mount,env:INIT_APPROLE_MOUNT" help:"Mount path of the AppRole auth method"`
+	AppRoleRoleID       string `arg:"--approle-role-id,env:INIT_APPROLE_ROLE_ID" help:"Role ID to log in with when using AppRole auth"`
+	AppRoleRoleIDFile   string `arg:"--approle-role-id-file,env:INIT_APPROLE_ROLE_ID_FILE" help:"File containing the Role ID to log in with when using AppRole auth"`
+	AppRoleSecretID     string `arg:"--approle-secret-id,env:INIT_APPROLE_SECRET_ID" help:"Secret ID to log in with when using AppRole auth"`
+	AppRoleSecretIDFile string `arg:"--approle-secret-id-file,env:INIT_APPROLE_SECRET_ID_FILE" help:"File containing the Secret ID to log in with when using AppRole auth"`
+
+	CertMount string `arg:"--cert-mount,env:INIT_CERT_MOUNT" help:"Mount path of the TLS certificate auth method"`
+	CertRole  string `arg:"--cert-role,env:INIT_CERT_ROLE" help:"Certificate role to log in as when using TLS certificate auth; optional"`
+
+	JWTFile  string `arg:"--jwt-file,env:INIT_JWT_FILE" help:"File containing the JWT to log in with when using JWT auth; re-read on every login"`
+	JWTMount string `arg:"--jwt-mount,env:INIT_JWT_MOUNT" help:"Mount path of the JWT/OIDC auth method"`
+	JWTRole  string `arg:"--jwt-role,env:INIT_JWT_ROLE" help:"Role to log in as when using JWT auth"`
+
+	KubernetesMount     string `arg:"--kubernetes-mount,env:INIT_KUBERNETES_MOUNT" help:"Mount path of the Kubernetes auth method"`
+	KubernetesRole      string `arg:"--kubernetes-role,env:INIT_KUBERNETES_ROLE" help:"Role to log in as when using Kubernetes auth"`
+	KubernetesTokenFile string `arg:"--kubernetes-token-file,env:INIT_KUBERNETES_TOKEN_FILE" help:"File containing the service account JWT to log in with when using Kubernetes auth"`
+
+	CacheFile         string         `arg:"--cache-file,env:INIT_CACHE_FILE" help:"Encrypted file the template context is cached in, to start from while Vault is unreachable. Disabled if blank."`
+	CacheKey          string         `arg:"--cache-key,env:INIT_CACHE_KEY" help:"Key the context cache is encrypted with"`
+	CacheKeyFile      string         `arg:"--cache-key-file,env:INIT_CACHE_KEY_FILE" help:"File containing the key the context cache is encrypted with"`
+	CacheMaxStaleness *time.Duration `arg:"--cache-max-staleness,env:INIT_CACHE_MAX_STALENESS" help:"How old the cached context may be to start from it while Vault is unreachable"`
+
 	TelemetryAddress          string `arg:"--telemetry-address,env:INIT_TELEMETRY_ADDR" help:"Address to expose Prometheus telemetry on. Disabled if blank."`
 	TelemetryCollectorGolang  *bool  `arg:"--use-go-telemetry-collector,env:INIT_TELEMETRY_COLLECTOR_GOLANG" help:"Whether the Golang telemetry collector should be started."`
 	TelemetryCollectorProcess *bool  `arg:"--use-process-telemetry-collector,env:INIT_TELEMETRY_COLLECTOR_PROCESS" help:"Whether the process telemetry collector should be started."`
@@ -63,6 +127,41 @@ type Config struct {
 func (c *Config) ValidateAndSetDefaults() error {
 	var err error
 
+	if c.CacheMaxStaleness == nil {
+		c.CacheMaxStaleness = new(time.Duration)
+		*c.CacheMaxStaleness, err = time.ParseDuration(defaultCacheMaxStaleness)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse default cache max staleness: `%s`", defaultCacheMaxStaleness)
+		}
+	}
+
+	if c.CacheFile != "" {
+		c.CacheKey, err = readCredential(c.CacheKey, c.CacheKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "could not read CacheKeyFile")
+		}
+
+		if c.CacheKey == "" {
+			return errors.New("CacheFile requires CacheKey or CacheKeyFile to be set")
+		}
+	}
+
+	if c.CollisionPolicy == "" {
+		c.CollisionPolicy = defaultCollisionPolicy
+	}
+
+	if err := secret.CollisionPolicy(c.CollisionPolicy).Validate(); err != nil {
+		return errors.Wrap(err, "invalid collision policy")
+	}
+
+	if c.ContextNesting == "" {
+		c.ContextNesting = defaultContextNesting
+	}
+
+	if err := secret.ContextNesting(c.ContextNesting).Validate(); err != nil {
+		return errors.Wrap(err, "invalid context nesting")
+	}
+
 	if c.Debug == nil {
 		c.Debug = new(bool)
 		*c.Debug = defaultDebug
@@ -88,11 +187,36 @@ func (c *Config) ValidateAndSetDefaults() error {
 		*c.NoInheritToken = defaultNoInheritToken
 	}
 
+	if c.KVRaw == nil {
+		c.KVRaw = new(bool)
+		*c.KVRaw = defaultKVRaw
+	}
+
+	if c.LeaseRevokeGrace == nil {
+		c.LeaseRevokeGrace = new(time.Duration)
+		*c.LeaseRevokeGrace, err = time.ParseDuration(defaultLeaseRevokeGrace)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse default lease revoke grace period: `%s`", defaultLeaseRevokeGrace)
+		}
+	}
+
 	if c.NoReaper == nil {
 		c.NoReaper = new(bool)
 		*c.NoReaper = defaultNoReaper
 	}
 
+	if c.PKIRenewFraction == nil {
+		c.PKIRenewFraction = new(float64)
+		*c.PKIRenewFraction, err = strconv.ParseFloat(defaultPKIRenewFraction, 64)
+		if err != nil {
+			return errors.Wrapf(err, "could not parse default PKI renew fraction: `%s`", defaultPKIRenewFraction)
+		}
+	}
+
+	if *c.PKIRenewFraction <= 0 || *c.PKIRenewFraction >= 1 {
+		return errors.Errorf("PKI renew fraction must be between 0 and 1, got: %v", *c.PKIRenewFraction)
+	}
+
 	if c.RefreshDuration == nil {
 		c.RefreshDuration = new(time.Duration)
 		*c.RefreshDuration, err = time.ParseDuration(defaultRefreshDuration)
@@ -109,6 +233,15 @@ func (c *Config) ValidateAndSetDefaults() error {
 		c.TokenTTL = defaultTokenTTL
 	}
 
+	if c.TransitMount == "" {
+		c.TransitMount = defaultTransitMount
+	}
+
+	if c.UnwrapToken == nil {
+		c.UnwrapToken = new(bool)
+		*c.UnwrapToken = defaultUnwrapToken
+	}
+
 	if c.Verbose == nil {
 		c.Verbose = new(bool)
 		*c.Verbose = defaultVerbose
@@ -120,11 +253,88 @@ func (c *Config) ValidateAndSetDefaults() error {
 		}
 	}
 
+	if c.Namespace != "" {
+		if os.Getenv(vaultApi.EnvVaultNamespace) != c.Namespace {
+			os.Setenv(vaultApi.EnvVaultNamespace, c.Namespace)
+		}
+	}
+
 	if c.TokenPeriod != "" && c.TokenTTL != "" {
 		return errors.New("TokenTTL and TokenPeriod are mutually exclusive; only one may be set")
 	}
 
-	if c.VaultToken == "" && c.VaultTokenFile == "" {
+	// A token role decides orphaning and periodicity on its own, so those
+	// options would be silently ignored by Vault if they were sent along.
+	if c.TokenRole != "" {
+		if *c.OrphanToken {
+			return errors.New("OrphanToken can not be used with TokenRole; the role controls whether the token is an orphan")
+		}
+
+		if c.TokenPeriod != "" {
+			return errors.New("TokenPeriod can not be used with TokenRole; the role controls the token period")
+		}
+	}
+
+	switch c.TokenType {
+	case "", "service":
+	case "batch":
+		if c.TokenPeriod != "" {
+			return errors.New("TokenPeriod can not be used with batch tokens")
+		}
+
+		if c.TokenNumUses != 0 {
+			return errors.New("TokenNumUses can not be used with batch tokens")
+		}
+	default:
+		return errors.Errorf("unknown token type: %s", c.TokenType)
+	}
+
+	if c.TokenEntityAlias != "" && c.TokenRole == "" {
+		return errors.New("TokenEntityAlias requires TokenRole to be set")
+	}
+
+	if *c.NoInheritToken && (c.ChildTokenWrapTTL != "" || c.ChildTokenFile != "") {
+		return errors.New("ChildTokenWrapTTL and ChildTokenFile can not be used with NoInheritToken")
+	}
+
+	if c.TokenNumUses < 0 {
+		return errors.New("TokenNumUses can not be negative")
+	}
+
+	// The limited token is only ever handed to the child
+	if *c.NoInheritToken && c.TokenNumUses != 0 {
+		return errors.New("TokenNumUses can not be used with NoInheritToken")
+	}
+
+	if c.AuthMethod == "" {
+		c.AuthMethod = defaultAuthMethod
+	}
+
+	if c.AppRoleMount == "" {
+		c.AppRoleMount = defaultAppRoleMount
+	}
+
+	if c.CertMount == "" {
+		c.CertMount = defaultCertMount
+	}
+
+	if c.JWTMount == "" {
+		c.JWTMount = defaultJWTMount
+	}
+
+	if c.KubernetesMount == "" {
+		c.KubernetesMount = defaultKubernetesMount
+	}
+
+	if c.KubernetesTokenFile == "" {
+		c.KubernetesTokenFile = defaultKubernetesTokenFile
+	}
+
+	if err := c.validateAuthMethod(); err != nil {
+		return errors.Wrap(err, "invalid auth method configuration")
+	}
+
+	if c.AuthMethod == AuthMethodToken && c.VaultToken == "" && c.VaultTokenFile == "" {
 		return fmt.Errorf("Both VaultToken and VaultTokenFile are unset")
 	} else if c.VaultToken != "" && c.VaultTokenFile != "" {
 		log.Warnf("Both VaultToken and VaultTokenFile are set, ignoring VaultTokenFile!")
@@ -132,23 +342,10 @@ func (c *Config) ValidateAndSetDefaults() error {
 	}
 
 	if c.VaultTokenFile != "" {
-		tokenFile, err := os.Open(c.VaultTokenFile)
-		if err != nil {
-			return errors.Wrap(err, "could not open VaultTokenFile")
-		}
-
-		defer tokenFile.Close()
-
-		tokenFileStat, err := tokenFile.Stat()
+		c.VaultToken, err = c.readVaultTokenFile()
 		if err != nil {
-			return errors.Wrap(err, "could not stat() VaultTokenFile")
+			return err
 		}
-
-		tokenFileSize := tokenFileStat.Size()
-		tokenBuf := make([]byte, tokenFileSize)
-		tokenFile.Read(tokenBuf)
-
-		c.VaultToken = strings.TrimSpace(string(tokenBuf))
 	}
 
 	if c.VaultToken != "" {
@@ -173,3 +370,17 @@ func (c *Config) ValidateAndSetDefaults() error {
 
 	return nil
 }
+
+// readVaultTokenFile reads the token stored in VaultTokenFile.
+func (c *Config) readVaultTokenFile() (string, error) {
+	token, err := readCredential("", c.VaultTokenFile)
+	if err != nil {
+		return "", errors.Wrap(err, "could not read VaultTokenFile")
+	}
+
+	if token == "" {
+		return "", errors.Errorf("VaultTokenFile `%s` is empty", c.VaultTokenFile)
+	}
+
+	return token, nil
+}
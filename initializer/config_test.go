@@ -0,0 +1,42 @@
+package initializer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestValidateTokenRole(t *testing.T) {
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	orphan, notOrphan := true, false
+	cases := []struct {
+		name        string
+		tokenRole   string
+		orphanToken *bool
+		tokenPeriod string
+		valid       bool
+	}{
+		{"role", "app", nil, "", true},
+		{"role with orphan token unset", "app", &notOrphan, "", true},
+		{"role with orphan token", "app", &orphan, "", false},
+		{"role with token period", "app", nil, "24h", false},
+		{"orphan token without role", "", &orphan, "", true},
+		{"token period without role", "", nil, "24h", true},
+	}
+
+	for _, c := range cases {
+		cfg := &Config{
+			OrphanToken: c.orphanToken,
+			TokenPeriod: c.tokenPeriod,
+			TokenRole:   c.tokenRole,
+			VaultToken:  "parent-token",
+		}
+
+		err := cfg.ValidateAndSetDefaults()
+		if c.valid && err != nil {
+			t.Errorf("%s: unexpected error validating config: %v", c.name, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%s: expected error validating config", c.name)
+		}
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"os"
 	"os/signal"
 
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
+	"glow.dev.maio.me/seanj/vault-init/internal/cache"
 	"glow.dev.maio.me/seanj/vault-init/internal/logformatter"
 	"glow.dev.maio.me/seanj/vault-init/internal/secret"
 	"glow.dev.maio.me/seanj/vault-init/internal/supervise"
@@ -34,12 +36,33 @@ func Run(ctx context.Context, config *Config) error {
 	// Load vaultclient-specific args into the vaultclient.Config struct
 	vaultCfg := vaultclient.NewConfigWithDefaults()
 	vaultCfg.AccessPolicies = config.AccessPolicies
+	vaultCfg.ChildTokenFile = config.ChildTokenFile
+	vaultCfg.ChildTokenWrapTTL = config.ChildTokenWrapTTL
+	vaultCfg.CollisionPolicy = secret.CollisionPolicy(config.CollisionPolicy)
+	vaultCfg.ContextNesting = secret.ContextNesting(config.ContextNesting)
 	vaultCfg.DisableTokenRenew = *config.DisableTokenRenew
+	vaultCfg.KVRaw = *config.KVRaw
+	vaultCfg.LeaseRevokeGrace = *config.LeaseRevokeGrace
+	vaultCfg.Namespace = config.Namespace
 	vaultCfg.NoInheritToken = *config.NoInheritToken
 	vaultCfg.OrphanToken = *config.OrphanToken
 	vaultCfg.Paths = config.Paths
+	vaultCfg.PKIRenewFraction = *config.PKIRenewFraction
+	vaultCfg.TokenBoundCIDRs = config.TokenBoundCIDRs
+	vaultCfg.TokenEntityAlias = config.TokenEntityAlias
+	vaultCfg.TokenExplicitMaxTTL = config.TokenExplicitMaxTTL
+	vaultCfg.TokenNumUses = config.TokenNumUses
 	vaultCfg.TokenPeriod = config.TokenPeriod
+	vaultCfg.TokenRole = config.TokenRole
 	vaultCfg.TokenTTL = config.TokenTTL
+	vaultCfg.TokenType = config.TokenType
+	vaultCfg.TransitMount = config.TransitMount
+
+	// Render the metadata that identifies the child token in the audit log
+	vaultCfg.TokenMetadata, err = config.renderTokenMetadata()
+	if err != nil {
+		log.WithError(err).Fatalf("Could not render child token metadata")
+	}
 
 	// Read common Vault client configuration variables from environment,
 	// storing them into the embedded `vaultApi.Config`
@@ -47,62 +70,51 @@ func Run(ctx context.Context, config *Config) error {
 		log.WithError(err).Fatalf("Could not create Vault config from environment")
 	}
 
+	// Cache the template context, so that the child can be started from it
+	// while Vault is unreachable
+	if config.CacheFile != "" {
+		vaultCfg.ContextCache, err = cache.New(config.CacheFile, []byte(config.CacheKey), *config.CacheMaxStaleness)
+		if err != nil {
+			log.WithError(err).Fatalf("Could not set up context cache")
+		}
+	}
+
 	// Initialize the vaultclient wrapper
 	vaultClient, err := buildVaultClient(vaultCfg)
 	if err != nil {
 		log.WithError(err).Fatalf("Could not create Vault client")
 	}
 
-	// Perform an initial health check on the Vault client
-	if err := vaultClient.Check(); err != nil {
-		log.WithError(err).Fatalf("Could not communicate with Vault")
-	}
-
-	// Create the child token and downgrade the Vault client to use it
 	tokenDisplayName := fmt.Sprintf("Generated by vault-init for process: %s", config.Command)
-	rawChildSecret, err := vaultClient.CreateChildToken(tokenDisplayName)
-	if err != nil {
-		log.WithError(err).Fatalf("Could not create child token")
-	}
-	childSecret := secret.WrapChildToken(rawChildSecret)
-
-	// Extract the secret and accessor
-	accessor, err := childSecret.TokenAccessor()
-	if err != nil {
-		log.WithError(err).Fatalf("Could not get child token's accessor ID")
-	}
+	tokens := newTokenManager(vaultClient, config, tokenDisplayName)
+	requestUpdate := vaultClient.RequestUpdate
 
-	secret, err := childSecret.TokenID()
-	if err != nil {
-		log.WithError(err).Fatalf("Could not get child token's secret ID")
-	}
-
-	// Downgrade the Vault client to use the child token
-	log.WithField("accessor_id", accessor).Infof("Downgrading Vault client to use child token")
-	if err := vaultClient.SetToken(secret); err != nil {
-		log.WithError(err).Fatalf("Could not use child token")
-	}
+	// Perform an initial health check on the Vault client. If Vault can not
+	// be reached, fall back to the cached template context, if configured
+	var updateCh chan []string
+	if err := vaultClient.Check(); err != nil {
+		if vaultCfg.ContextCache == nil {
+			log.WithError(err).Fatalf("Could not communicate with Vault")
+		}
 
-	// Overwrite the VAULT_TOKEN environment variable with the child token
-	// to prevent leaking the parent token to the child process
-	os.Setenv("VAULT_TOKEN", secret)
+		log.WithError(err).Errorf("Could not communicate with Vault")
 
-	// Start the child token renewer
-	if err := vaultClient.StartSecretRenewer(childSecret); err != nil {
-		log.WithError(err).Fatalf("Could not start child token renewer")
-	}
+		start, err := startFromCache(ctx, vaultClient, config, tokens)
+		if err != nil {
+			log.WithError(err).Fatalf("Could not start from cached template context")
+		}
 
-	defer vaultClient.StopSecretRenewer(childSecret)
+		updateCh = start.updateCh
+		requestUpdate = start.RequestUpdate
+	} else {
+		updateCh, err = newBootstrap(vaultClient, config, tokens).start(ctx)
+		if err != nil {
+			log.WithError(err).Fatalf("Could not start")
+		}
 
-	// Start the secret watcher
-	log.WithField("paths", config.Paths).Debugf("Starting secrets watcher")
-	updateCh, err := vaultClient.StartWatcher(ctx, *config.RefreshDuration)
-	if err != nil {
-		log.WithError(err).Fatalf("Could not start secrets watcher")
+		defer close(updateCh)
 	}
 
-	defer close(updateCh)
-
 	// Configure the process supervisor
 	supervisorCfg := &supervise.Config{
 		Command:       config.Command,
@@ -110,6 +122,18 @@ func Run(ctx context.Context, config *Config) error {
 		OneShot:       *config.OneShot,
 	}
 
+	// Wrapping tokens can only be unwrapped once, so a restarted child
+	// needs a new wrapping token and an environment rendered with it
+	if config.ChildTokenWrapTTL != "" {
+		supervisorCfg.RequestEnvironment = func() error {
+			if err := tokens.handOverAgain(); err != nil {
+				return errors.Wrap(err, "could not hand child token over again")
+			}
+
+			return requestUpdate()
+		}
+	}
+
 	// Create the supervisor with the configuration
 	supervisor := supervise.NewSupervisor(supervisorCfg)
 
@@ -135,12 +159,17 @@ func Run(ctx context.Context, config *Config) error {
 	// Cleanup and shutdown
 	log.Infof("vault-init shutting down")
 
-	// Revoke the child token
-	err = vaultClient.RevokeSecret(childSecret)
-	if err != nil {
-		log.WithError(err).Errorf("Could not revoke child token")
-	} else {
-		log.WithField("accessor_id", accessor).Debugf("Child token has been revoked")
+	// Stop the remaining goroutines, including the token manager
+	cancel()
+
+	// Revoke the leases of all dynamic secrets that were fetched
+	if err := vaultClient.RevokeLeases(); err != nil {
+		log.WithError(err).Errorf("Could not revoke all secret leases")
+	}
+
+	// Stop the token renewers and revoke the child token
+	if err := tokens.Stop(); err != nil {
+		log.WithError(err).Errorf("Could not stop token manager")
 	}
 
 	return nil
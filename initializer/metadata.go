@@ -0,0 +1,84 @@
+package initializer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// containerIDPattern matches the 64 character IDs container runtimes use in
+// cgroup paths and mount sources.
+var containerIDPattern = regexp.MustCompile(`[0-9a-f]{64}`)
+
+// tokenMetadataContext is the template context token metadata values are
+// rendered with.
+type tokenMetadataContext struct {
+	Command     string
+	ContainerID string
+	Hostname    string
+}
+
+// renderTokenMetadata parses the `key=value` pairs in TokenMetadata, laid over
+// the default metadata, and renders each value as a template. Keys that render
+// to an empty value are left out.
+func (c *Config) renderTokenMetadata() (map[string]string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithError(err).Warnf("Could not determine hostname for token metadata")
+	}
+
+	context := &tokenMetadataContext{
+		Command:     strings.Join(c.Command, " "),
+		ContainerID: containerID(),
+		Hostname:    hostname,
+	}
+
+	metadata := make(map[string]string, 0)
+	for _, pair := range append(defaultTokenMetadata, c.TokenMetadata...) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("token metadata `%s` is not a key=value pair", pair)
+		}
+
+		tpl, err := template.New(parts[0]).Parse(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse template for token metadata `%s`", parts[0])
+		}
+
+		rendered := bytes.NewBufferString("")
+		if err := tpl.Execute(rendered, context); err != nil {
+			return nil, errors.Wrapf(err, "could not render template for token metadata `%s`", parts[0])
+		}
+
+		if rendered.Len() == 0 {
+			delete(metadata, parts[0])
+			continue
+		}
+
+		metadata[parts[0]] = rendered.String()
+	}
+
+	return metadata, nil
+}
+
+// containerID attempts to find the ID of the container vault-init is running
+// in. Returns an empty string if it can not be determined.
+func containerID() string {
+	for _, path := range []string{"/proc/self/cgroup", "/proc/self/mountinfo"} {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		if id := containerIDPattern.Find(contents); id != nil {
+			return string(id)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,38 @@
+package initializer
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRenderTokenMetadata(t *testing.T) {
+	hostname, _ := os.Hostname()
+
+	cfg := &Config{
+		Command:       []string{"/bin/app", "--serve"},
+		TokenMetadata: []string{"service=app", "cmd={{.Command}}", "container_id=fixed"},
+	}
+
+	metadata, err := cfg.renderTokenMetadata()
+	if err != nil {
+		t.Fatalf("unexpected error rendering token metadata: %v", err)
+	}
+
+	expected := map[string]string{
+		"hostname":     hostname,
+		"container_id": "fixed",
+		"service":      "app",
+		"cmd":          "/bin/app --serve",
+	}
+
+	for key, value := range expected {
+		if metadata[key] != value {
+			t.Errorf("expected metadata `%s` to be '%s', got: '%s'", key, value, metadata[key])
+		}
+	}
+
+	cfg.TokenMetadata = []string{"no-value"}
+	if _, err := cfg.renderTokenMetadata(); err == nil {
+		t.Errorf("expected error rendering metadata that is not a key=value pair")
+	}
+}
@@ -0,0 +1,617 @@
+package initializer
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+)
+
+// tokenManager owns vault-init's own (parent) token and the child token that
+// is created from it. It watches the lifetime of both and, once either can no
+// longer be renewed or was revoked, logs in again if needed, creates a new
+// child token and asks the watcher to send the child a fresh environment.
+type tokenManager struct {
+	client      vaultclient.VaultClient
+	config      *Config
+	displayName string
+
+	// lock guards all of the fields below
+	lock sync.Mutex
+
+	parent        *secret.Secret
+	parentRenewer *vaultApi.Renewer
+	child         *secret.Secret
+	childRenewer  *vaultApi.Renewer
+
+	// handoff is the token handed to the child process instead of the child
+	// token when TokenNumUses limits its uses. vault-init itself keeps
+	// using the child token.
+	handoff        *secret.Secret
+	handoffRenewer *vaultApi.Renewer
+
+	// retired holds the timers revoking replaced tokens once the lease
+	// revoke grace period has passed
+	retired map[*secret.Secret]*time.Timer
+
+	// parentExpiring is set once a token given with the token auth method can
+	// no longer be renewed. It is cleared when a new token is read from
+	// VaultTokenFile.
+	parentExpiring bool
+
+	// tokenFileContents is the token last read from VaultTokenFile, which
+	// may differ from VaultToken if it was a response-wrapping token
+	tokenFileContents string
+}
+
+func newTokenManager(client vaultclient.VaultClient, config *Config, displayName string) *tokenManager {
+	return &tokenManager{
+		client:      client,
+		config:      config,
+		displayName: displayName,
+		retired:     make(map[*secret.Secret]*time.Timer),
+	}
+}
+
+// Start authenticates vault-init, creates the first child token and
+// downgrades the Vault client to use it.
+func (m *tokenManager) Start() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.watchesTokenFile() {
+		contents, err := m.config.readVaultTokenFile()
+		if err != nil {
+			return err
+		}
+
+		m.tokenFileContents = contents
+	}
+
+	if err := m.refreshParent(); err != nil {
+		return errors.Wrap(err, "could not authenticate to Vault")
+	}
+
+	if err := m.replaceChild(); err != nil {
+		return errors.Wrap(err, "could not create child token")
+	}
+
+	return nil
+}
+
+// Watch waits for either token to reach the end of its lifetime and replaces
+// them as needed. On every tick of the refresh duration, VaultTokenFile is
+// checked for a rotated token and the child token is checked for revocation.
+func (m *tokenManager) Watch(ctx context.Context, refreshDuration time.Duration) {
+	// Other events must not delay the checks, so the ticker is shared by all
+	// iterations
+	ticker := time.NewTicker(refreshDuration)
+	defer ticker.Stop()
+
+	for {
+		m.lock.Lock()
+		parentDoneCh := renewerDoneCh(m.parentRenewer)
+		childDoneCh := renewerDoneCh(m.childRenewer)
+		handoffDoneCh := renewerDoneCh(m.handoffRenewer)
+		m.lock.Unlock()
+
+		var err error
+		select {
+		case <-ctx.Done():
+			log.Debugf("Token manager exiting")
+			return
+		case <-parentDoneCh:
+			err = m.parentDone()
+		case <-childDoneCh:
+			err = m.childDone()
+		case <-handoffDoneCh:
+			err = m.childDone()
+		case <-ticker.C:
+			err = m.checkTokenFile()
+			if err == nil {
+				err = m.checkChild()
+			}
+		}
+
+		if err != nil {
+			log.WithError(err).Errorf("Could not replace tokens; retrying in %s", refreshDuration.String())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(refreshDuration):
+			}
+		}
+	}
+}
+
+// Stop stops the token renewers and revokes the child token, along with the
+// token handed to the child process and replaced tokens still pending
+// revocation.
+func (m *tokenManager) Stop() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	stopRenewer(m.parentRenewer)
+	stopRenewer(m.childRenewer)
+	stopRenewer(m.handoffRenewer)
+
+	for sec, timer := range m.retired {
+		timer.Stop()
+		delete(m.retired, sec)
+		m.revokeRetired(sec)
+	}
+
+	if m.handoff != nil {
+		if err := m.client.RevokeSecret(m.handoff); err != nil {
+			log.WithError(err).Warnf("Could not revoke token handed to the child")
+		}
+	}
+
+	if m.child == nil {
+		return nil
+	}
+
+	if err := m.client.RevokeSecret(m.child); err != nil {
+		return errors.Wrap(err, "could not revoke child token")
+	}
+
+	accessor, _ := m.child.TokenAccessor()
+	log.WithField("accessor_id", accessor).Debugf("Child token has been revoked")
+
+	return nil
+}
+
+// parentDone handles vault-init's own token reaching the end of its
+// lifetime. With the token auth method there is nothing to log in again with,
+// so the token is left to expire, unless VaultTokenFile provides a new one.
+func (m *tokenManager) parentDone() error {
+	if m.config.AuthMethod != AuthMethodToken {
+		log.Infof("vault-init's own token can no longer be renewed; authenticating again")
+		return m.rotate(true)
+	}
+
+	m.lock.Lock()
+	m.parentExpiring = true
+	m.lock.Unlock()
+
+	if m.watchesTokenFile() {
+		log.Errorf("vault-init's own token is expiring and can not be renewed; write a new token to VaultTokenFile to replace it")
+	} else {
+		log.Errorf("vault-init's own token is expiring and can not be renewed; restart vault-init with a new VaultToken")
+	}
+
+	return nil
+}
+
+// childDone replaces the child token once it can no longer be renewed. While
+// the parent token is expiring, a new child token would be capped to its
+// remaining lifetime, so the child token is left to expire along with it.
+func (m *tokenManager) childDone() error {
+	if m.isParentExpiring() {
+		log.Errorf("Child token can no longer be renewed, and can not be replaced while vault-init's own token is expiring")
+		return nil
+	}
+
+	log.Infof("Child token can no longer be renewed; replacing it")
+	return m.rotate(false)
+}
+
+// isParentExpiring returns true if vault-init's own token is expiring and can
+// not be replaced.
+func (m *tokenManager) isParentExpiring() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.parentExpiring
+}
+
+// checkChild rotates the child token if Vault no longer accepts it.
+func (m *tokenManager) checkChild() error {
+	// A new child token could not outlive the parent token anyway
+	if m.isParentExpiring() {
+		return nil
+	}
+
+	lookup, err := m.client.LookupSelf()
+	if err != nil {
+		return errors.Wrap(err, "could not check child token")
+	}
+
+	if lookup != nil {
+		return nil
+	}
+
+	log.Warnf("Child token is no longer valid; replacing it")
+	return m.rotate(false)
+}
+
+// checkTokenFile re-reads VaultTokenFile and, if the platform rotated the
+// token stored in it, switches to the new token and replaces the child token.
+func (m *tokenManager) checkTokenFile() error {
+	if !m.watchesTokenFile() {
+		return nil
+	}
+
+	contents, err := m.config.readVaultTokenFile()
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	changed := contents != m.tokenFileContents
+	m.lock.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	log.Infof("VaultTokenFile has changed; reloading token")
+	previousToken := m.config.VaultToken
+	m.config.VaultToken = contents
+	if err := unwrapBootstrapToken(m.client, m.config); err != nil {
+		m.config.VaultToken = previousToken
+		return errors.Wrap(err, "could not unwrap reloaded token")
+	}
+
+	if err := m.rotate(true); err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	m.tokenFileContents = contents
+	m.lock.Unlock()
+
+	return nil
+}
+
+// watchesTokenFile determines whether vault-init's own token comes from a
+// file that should be watched for rotation.
+func (m *tokenManager) watchesTokenFile() bool {
+	return m.config.AuthMethod == AuthMethodToken && m.config.VaultTokenFile != ""
+}
+
+// rotate creates a new child token, optionally authenticating vault-init
+// again first, and asks for leased secrets to be fetched again with it. If
+// creating the child fails with the current parent token, authentication is
+// retried. Replaced tokens are revoked after the lease revoke grace period,
+// as revoking the child token revokes the leases it created as well.
+func (m *tokenManager) rotate(reauth bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	oldChild, oldHandoff := m.child, m.handoff
+
+	// Unless a new child token was put in place, switch the client back to
+	// the previous one, so that it is never left using the parent token
+	defer func() {
+		if m.child == oldChild && oldChild != nil {
+			m.restoreChild(oldChild)
+		}
+	}()
+
+	if reauth {
+		if err := m.refreshParent(); err != nil {
+			return errors.Wrap(err, "could not authenticate to Vault")
+		}
+	} else if err := m.client.SetToken(m.parentToken()); err != nil {
+		return errors.Wrap(err, "could not switch back to parent token")
+	}
+
+	if err := m.replaceChild(); err != nil {
+		if reauth {
+			return errors.Wrap(err, "could not create child token")
+		}
+
+		log.WithError(err).Warnf("Could not create child token with current parent token; authenticating again")
+		if err := m.refreshParent(); err != nil {
+			return errors.Wrap(err, "could not authenticate to Vault")
+		}
+
+		if err := m.replaceChild(); err != nil {
+			return errors.Wrap(err, "could not create child token")
+		}
+	}
+
+	if err := m.client.RequestRefetch(); err != nil {
+		return errors.Wrap(err, "could not request leased secrets to be fetched with new child token")
+	}
+
+	m.retireToken(oldChild)
+	m.retireToken(oldHandoff)
+
+	return nil
+}
+
+// restoreChild switches the client back to the given child token after a
+// failed rotation.
+func (m *tokenManager) restoreChild(child *secret.Secret) {
+	token, err := child.TokenID()
+	if err == nil {
+		err = m.client.SetToken(token)
+	}
+
+	if err != nil {
+		log.WithError(err).Errorf("Could not switch back to previous child token")
+	}
+}
+
+// retireToken revokes a replaced token once the lease revoke grace period
+// has passed. The lock must be held.
+func (m *tokenManager) retireToken(sec *secret.Secret) {
+	if sec == nil {
+		return
+	}
+
+	grace := m.client.GetConfig().LeaseRevokeGrace
+	accessor, _ := sec.TokenAccessor()
+	log.WithField("accessor_id", accessor).Debugf("Revoking replaced token in %s", grace.String())
+
+	m.retired[sec] = time.AfterFunc(grace, func() {
+		m.lock.Lock()
+		_, pending := m.retired[sec]
+		delete(m.retired, sec)
+		m.lock.Unlock()
+
+		// Stop revokes the tokens that are still pending itself
+		if pending {
+			m.revokeRetired(sec)
+		}
+	})
+}
+
+// revokeRetired revokes a replaced token.
+func (m *tokenManager) revokeRetired(sec *secret.Secret) {
+	accessor, _ := sec.TokenAccessor()
+	if err := m.client.RevokeSecret(sec); err != nil {
+		log.WithField("accessor_id", accessor).WithError(err).Warnf("Could not revoke replaced token")
+		return
+	}
+
+	log.WithField("accessor_id", accessor).Debugf("Replaced token has been revoked")
+}
+
+// refreshParent logs in with the configured auth method or, for the token
+// auth method, switches back to the configured token. A renewer is started
+// for the resulting token unless it never expires.
+func (m *tokenManager) refreshParent() error {
+	stopRenewer(m.parentRenewer)
+	m.parentRenewer = nil
+
+	loginSecret, err := authenticate(m.client, m.config)
+	if err != nil {
+		return err
+	}
+
+	if loginSecret == nil {
+		if err := m.client.SetToken(m.config.VaultToken); err != nil {
+			return errors.Wrap(err, "could not use VaultToken")
+		}
+
+		loginSecret, err = m.lookupParent()
+		if err != nil {
+			return err
+		}
+	}
+
+	m.parent = secret.New("PARENT_TOKEN", loginSecret)
+	m.parentExpiring = false
+	m.parentRenewer, err = m.startRenewer(m.parent)
+
+	return err
+}
+
+// lookupParent builds an auth secret for the configured VaultToken, which the
+// client must currently be using, so that its lifetime can be watched.
+func (m *tokenManager) lookupParent() (*vaultApi.Secret, error) {
+	lookup, err := m.client.LookupSelf()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not look up VaultToken")
+	} else if lookup == nil {
+		return nil, errors.New("VaultToken is not valid")
+	}
+
+	ttl, _ := lookup.TokenTTL()
+	renewable, _ := lookup.TokenIsRenewable()
+	accessor, _ := lookup.TokenAccessor()
+
+	return &vaultApi.Secret{
+		Auth: &vaultApi.SecretAuth{
+			ClientToken:   m.config.VaultToken,
+			Accessor:      accessor,
+			Renewable:     renewable,
+			LeaseDuration: int(ttl.Seconds()),
+		},
+	}, nil
+}
+
+// replaceChild creates a new child token with the parent token the client is
+// currently using, then downgrades the client to the new child token. When
+// TokenNumUses is set, a separate token limited to that many uses is created
+// for the child process as well.
+func (m *tokenManager) replaceChild() error {
+	rawChildSecret, err := m.client.CreateChildToken(m.displayName)
+	if err != nil {
+		return err
+	}
+	childSecret := secret.WrapChildToken(rawChildSecret)
+
+	handoffSecret, err := m.createHandoff()
+	if err != nil {
+		if err := m.client.RevokeSecret(childSecret); err != nil {
+			log.WithError(err).Warnf("Could not revoke unused child token")
+		}
+
+		return err
+	}
+
+	accessor, err := childSecret.TokenAccessor()
+	if err != nil {
+		return errors.Wrap(err, "could not get child token's accessor ID")
+	}
+
+	token, err := childSecret.TokenID()
+	if err != nil {
+		return errors.Wrap(err, "could not get child token's secret ID")
+	}
+
+	handoffToken := ""
+	if handoffSecret != nil {
+		handoffToken, _ = handoffSecret.TokenID()
+	}
+
+	// Wrapping and writing the token file once per child token, rather than
+	// on every render, keeps a running child's wrapping token valid
+	if err := m.client.HandOverChildToken(handedOverToken(token, handoffToken)); err != nil {
+		for _, unused := range []*secret.Secret{childSecret, handoffSecret} {
+			if unused == nil {
+				continue
+			}
+
+			if err := m.client.RevokeSecret(unused); err != nil {
+				log.WithError(err).Warnf("Could not revoke unused token `%s`", unused.Path)
+			}
+		}
+
+		return errors.Wrap(err, "could not hand child token over")
+	}
+
+	log.WithField("accessor_id", accessor).Infof("Downgrading Vault client to use child token")
+	if err := m.client.SetToken(token); err != nil {
+		return errors.Wrap(err, "could not use child token")
+	}
+
+	m.client.SetHandoffToken(handoffToken)
+
+	// Overwrite the VAULT_TOKEN environment variable with the token handed
+	// to the child to prevent leaking the parent token to the child process.
+	// When the child gets a wrapped token, it must not see the raw one either.
+	if m.config.ChildTokenWrapTTL != "" {
+		os.Unsetenv(vaultApi.EnvVaultToken)
+	} else if handoffToken != "" {
+		os.Setenv(vaultApi.EnvVaultToken, handoffToken)
+	} else {
+		os.Setenv(vaultApi.EnvVaultToken, token)
+	}
+
+	stopRenewer(m.childRenewer)
+	m.child = childSecret
+	m.childRenewer, err = m.startRenewer(childSecret)
+	if err != nil {
+		return err
+	}
+
+	stopRenewer(m.handoffRenewer)
+	m.handoff = handoffSecret
+	m.handoffRenewer = nil
+	if handoffSecret != nil {
+		m.handoffRenewer, err = m.startRenewer(handoffSecret)
+	}
+
+	return err
+}
+
+// handOverAgain hands the current child token over once more, so that a
+// restarted child gets a new wrapping token. Does nothing before the first
+// child token was created.
+func (m *tokenManager) handOverAgain() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.child == nil {
+		return nil
+	}
+
+	token, err := m.child.TokenID()
+	if err != nil {
+		return errors.Wrap(err, "could not get child token's secret ID")
+	}
+
+	handoffToken := ""
+	if m.handoff != nil {
+		handoffToken, _ = m.handoff.TokenID()
+	}
+
+	return m.client.HandOverChildToken(handedOverToken(token, handoffToken))
+}
+
+// handedOverToken returns the token handed to the child process: the
+// handoff token if there is one, the child token otherwise.
+func handedOverToken(childToken, handoffToken string) string {
+	if handoffToken != "" {
+		return handoffToken
+	}
+
+	return childToken
+}
+
+// createHandoff creates the token handed to the child process if TokenNumUses
+// is set. Returns nil otherwise, as the child token is handed over instead.
+func (m *tokenManager) createHandoff() (*secret.Secret, error) {
+	if m.config.TokenNumUses == 0 {
+		return nil, nil
+	}
+
+	rawHandoffSecret, err := m.client.CreateHandoffToken(m.displayName)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create token handed to the child")
+	}
+
+	handoffSecret := secret.New("HANDOFF_TOKEN", rawHandoffSecret)
+	if _, err := handoffSecret.TokenID(); err != nil {
+		return nil, errors.Wrap(err, "could not get secret ID of token handed to the child")
+	}
+
+	return handoffSecret, nil
+}
+
+// startRenewer starts watching the lifetime of a token. Non-renewable tokens
+// are watched as well, so that they are replaced shortly before they expire.
+// Returns nil for tokens that never expire.
+func (m *tokenManager) startRenewer(sec *secret.Secret) (*vaultApi.Renewer, error) {
+	if sec.Auth == nil || sec.Auth.LeaseDuration == 0 {
+		log.Debugf("Token `%s` does not expire; not watching its lifetime", sec.Path)
+		return nil, nil
+	}
+
+	renewer, err := m.client.NewLeaseRenewer(&vaultApi.RenewerInput{
+		Secret: sec.Secret,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not start renewer for token `%s`", sec.Path)
+	}
+
+	if renewer != nil {
+		go renewer.Renew()
+	}
+
+	return renewer, nil
+}
+
+// parentToken returns the client token of the current parent secret.
+func (m *tokenManager) parentToken() string {
+	if m.parent == nil || m.parent.Auth == nil {
+		return m.config.VaultToken
+	}
+
+	return m.parent.Auth.ClientToken
+}
+
+func renewerDoneCh(renewer *vaultApi.Renewer) <-chan error {
+	if renewer == nil {
+		return nil
+	}
+
+	return renewer.DoneCh()
+}
+
+func stopRenewer(renewer *vaultApi.Renewer) {
+	if renewer != nil {
+		renewer.Stop()
+	}
+}
@@ -0,0 +1,377 @@
+package initializer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient/real"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func startTestTokenManager(t *testing.T, ctx context.Context, server *vaulttest.Server, cfg *Config) (*tokenManager, chan []string) {
+	vaultCfg := server.Config()
+	vaultCfg.LeaseRevokeGrace = 10 * time.Millisecond
+	vaultCfg.ChildTokenFile = cfg.ChildTokenFile
+	vaultCfg.ChildTokenWrapTTL = cfg.ChildTokenWrapTTL
+	vaultCfg.Paths = cfg.Paths
+	vaultCfg.TokenNumUses = cfg.TokenNumUses
+
+	client, err := real.NewClient(vaultCfg)
+	if err != nil {
+		t.Fatalf("could not create Vault client: %v", err)
+	}
+
+	tokens := newTokenManager(client, cfg, "test")
+	if err := tokens.Start(); err != nil {
+		t.Fatalf("unexpected error starting token manager: %v", err)
+	}
+
+	updateCh, err := client.StartWatcher(ctx, time.Hour)
+	if err != nil {
+		t.Fatalf("could not start watcher: %v", err)
+	}
+
+	return tokens, updateCh
+}
+
+// waitForRevoked waits for count tokens to be revoked once the grace period
+// has passed, and returns the sorted accessors of all revoked tokens.
+func waitForRevoked(t *testing.T, server *vaulttest.Server, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		revoked := server.Requests("/v1/auth/token/revoke-accessor").Fields("accessor")
+		if len(revoked) >= count || time.Now().After(deadline) {
+			sort.Strings(revoked)
+			return revoked
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTokenManagerReplacesRevokedChild(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unwrapToken := false
+	tokens, _ := startTestTokenManager(t, ctx, server, &Config{
+		AuthMethod:  AuthMethodToken,
+		UnwrapToken: &unwrapToken,
+		VaultToken:  "parent-token",
+	})
+
+	server.RevokeToken("child-1")
+	if err := tokens.checkChild(); err != nil {
+		t.Fatalf("unexpected error checking child token: %v", err)
+	}
+
+	if token, _ := tokens.child.TokenID(); token != "child-2" {
+		t.Errorf("expected revoked child token to be replaced by 'child-2', got: %s", token)
+	}
+
+	if os.Getenv("VAULT_TOKEN") != "child-2" {
+		t.Errorf("expected VAULT_TOKEN to be the new child token, got: %s", os.Getenv("VAULT_TOKEN"))
+	}
+
+	if createdWith := server.Requests("/v1/auth/token/create").Tokens(); len(createdWith) != 2 || createdWith[1] != "parent-token" {
+		t.Errorf("expected child tokens to be created with the parent token, got: %v", createdWith)
+	}
+
+	if revoked := waitForRevoked(t, server, 1); len(revoked) != 1 || revoked[0] != "accessor-1" {
+		t.Errorf("expected the replaced child token to be revoked, got: %v", revoked)
+	}
+}
+
+func TestTokenManagerReloadsTokenFile(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("parent-token\n"), 0600); err != nil {
+		t.Fatalf("could not write token file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unwrapToken := false
+	tokens, _ := startTestTokenManager(t, ctx, server, &Config{
+		AuthMethod:     AuthMethodToken,
+		UnwrapToken:    &unwrapToken,
+		VaultToken:     "parent-token",
+		VaultTokenFile: tokenFile,
+	})
+
+	// An unchanged file must not cause a new child token
+	if err := tokens.checkTokenFile(); err != nil {
+		t.Fatalf("unexpected error checking token file: %v", err)
+	}
+
+	if createdWith := server.Requests("/v1/auth/token/create").Tokens(); len(createdWith) != 1 {
+		t.Errorf("expected a single child token before rotation, got: %v", createdWith)
+	}
+
+	if err := ioutil.WriteFile(tokenFile, []byte("rotated-token\n"), 0600); err != nil {
+		t.Fatalf("could not write token file: %v", err)
+	}
+
+	if err := tokens.checkTokenFile(); err != nil {
+		t.Fatalf("unexpected error checking token file: %v", err)
+	}
+
+	if createdWith := server.Requests("/v1/auth/token/create").Tokens(); len(createdWith) != 2 || createdWith[1] != "rotated-token" {
+		t.Errorf("expected a new child token created with the rotated token, got: %v", createdWith)
+	}
+}
+
+func TestTokenManagerLetsExpiringTokenExpire(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("parent-token\n"), 0600); err != nil {
+		t.Fatalf("could not write token file: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unwrapToken := false
+	tokens, _ := startTestTokenManager(t, ctx, server, &Config{
+		AuthMethod:     AuthMethodToken,
+		UnwrapToken:    &unwrapToken,
+		VaultToken:     "parent-token",
+		VaultTokenFile: tokenFile,
+	})
+
+	// Neither the expiring parent token, nor the child tokens that can not
+	// outlive it, may cause new child tokens
+	if err := tokens.parentDone(); err != nil {
+		t.Fatalf("unexpected error handling expiring parent token: %v", err)
+	}
+
+	if err := tokens.childDone(); err != nil {
+		t.Fatalf("unexpected error handling expiring child token: %v", err)
+	}
+
+	server.RevokeToken("child-1")
+	if err := tokens.checkChild(); err != nil {
+		t.Fatalf("unexpected error checking child token: %v", err)
+	}
+
+	if createdWith := server.Requests("/v1/auth/token/create").Tokens(); len(createdWith) != 1 {
+		t.Errorf("expected no new child tokens while the parent token is expiring, got: %v", createdWith)
+	}
+
+	// A new token in the token file replaces the expiring one
+	if err := ioutil.WriteFile(tokenFile, []byte("rotated-token\n"), 0600); err != nil {
+		t.Fatalf("could not write token file: %v", err)
+	}
+
+	if err := tokens.checkTokenFile(); err != nil {
+		t.Fatalf("unexpected error checking token file: %v", err)
+	}
+
+	if createdWith := server.Requests("/v1/auth/token/create").Tokens(); len(createdWith) != 2 || createdWith[1] != "rotated-token" || tokens.isParentExpiring() {
+		t.Errorf("expected the rotated token to replace the expiring one, got: %v", createdWith)
+	}
+}
+
+func TestTokenManagerHandsOffLimitedToken(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unwrapToken := false
+	tokens, _ := startTestTokenManager(t, ctx, server, &Config{
+		AuthMethod:   AuthMethodToken,
+		TokenNumUses: 3,
+		UnwrapToken:  &unwrapToken,
+		VaultToken:   "parent-token",
+	})
+
+	// vault-init keeps the unlimited child token, while the child gets the limited one
+	if numUses := server.Requests("/v1/auth/token/create").Fields("num_uses"); len(numUses) != 2 || numUses[0] != "0" || numUses[1] != "3" {
+		t.Errorf("expected an unlimited child token and a token limited to 3 uses, got: %v", numUses)
+	}
+
+	if os.Getenv("VAULT_TOKEN") != "child-2" {
+		t.Errorf("expected VAULT_TOKEN to be the limited token, got: %s", os.Getenv("VAULT_TOKEN"))
+	}
+
+	dataMap, err := tokens.client.InjectChildContext(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("unexpected error injecting child context: %v", err)
+	}
+
+	if token := dataMap["Vault"].(map[string]interface{})["token"]; token != "child-2" {
+		t.Errorf("expected the limited token in the template context, got: %v", token)
+	}
+
+	server.RevokeToken("child-1")
+	if err := tokens.checkChild(); err != nil {
+		t.Fatalf("unexpected error checking child token: %v", err)
+	}
+
+	if revoked := waitForRevoked(t, server, 2); len(revoked) != 2 || revoked[0] != "accessor-1" || revoked[1] != "accessor-2" {
+		t.Errorf("expected both replaced tokens to be revoked, got: %v", revoked)
+	}
+
+	if os.Getenv("VAULT_TOKEN") != "child-4" {
+		t.Errorf("expected VAULT_TOKEN to be the new limited token, got: %s", os.Getenv("VAULT_TOKEN"))
+	}
+}
+
+func TestTokenManagerWrapsChildTokenOncePerHandOver(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	server.Handle("/v1/sys/wrapping/wrap", func(w http.ResponseWriter, r *vaulttest.Request) {
+		wrapped := len(server.Requests("/v1/sys/wrapping/wrap"))
+		fmt.Fprintf(w, `{"wrap_info": {"token": "wrapped-%d", "accessor": "wrapped-accessor-%d", "ttl": 60}}`, wrapped, wrapped)
+	})
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unwrapToken := false
+	tokens, _ := startTestTokenManager(t, ctx, server, &Config{
+		AuthMethod:        AuthMethodToken,
+		ChildTokenFile:    tokenFile,
+		ChildTokenWrapTTL: "1m",
+		UnwrapToken:       &unwrapToken,
+		VaultToken:        "parent-token",
+	})
+
+	// Rendering must not use up the wrapping token a running child may
+	// not have unwrapped yet
+	expectWrapped := func(expected string) {
+		t.Helper()
+
+		for i := 0; i < 2; i++ {
+			dataMap, err := tokens.client.InjectChildContext(map[string]interface{}{})
+			if err != nil {
+				t.Fatalf("unexpected error injecting child context: %v", err)
+			}
+
+			if wrapped := dataMap["Vault"].(map[string]interface{})["wrapped_token"]; wrapped != expected {
+				t.Errorf("expected wrapped token '%s' in the template context, got: %v", expected, wrapped)
+			}
+		}
+
+		if contents, _ := ioutil.ReadFile(tokenFile); string(contents) != expected {
+			t.Errorf("expected child token file to hold '%s', got: %s", expected, contents)
+		}
+	}
+
+	expectWrapped("wrapped-1")
+
+	if err := tokens.handOverAgain(); err != nil {
+		t.Fatalf("unexpected error handing child token over again: %v", err)
+	}
+	expectWrapped("wrapped-2")
+
+	server.RevokeToken("child-1")
+	if err := tokens.checkChild(); err != nil {
+		t.Fatalf("unexpected error checking child token: %v", err)
+	}
+	expectWrapped("wrapped-3")
+
+	if wrappedWith := server.Requests("/v1/sys/wrapping/wrap").Fields("token"); len(wrappedWith) != 3 || wrappedWith[0] != "child-1" || wrappedWith[1] != "child-1" || wrappedWith[2] != "child-2" {
+		t.Errorf("expected each child token to be wrapped once per hand-over, got: %v", wrappedWith)
+	}
+}
+
+func TestTokenManagerRefetchesLeasesWithNewChild(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	server.Respond("/v1/database/creds/app", http.StatusOK, `{"lease_id": "database/creds/app/lease", "lease_duration": 3600, "data": {"password": "app"}}`)
+	server.Respond("/v1/sys/leases/revoke", http.StatusNoContent, "")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unwrapToken := false
+	tokens, updateCh := startTestTokenManager(t, ctx, server, &Config{
+		AuthMethod:  AuthMethodToken,
+		Paths:       []string{"database/creds/app"},
+		UnwrapToken: &unwrapToken,
+		VaultToken:  "parent-token",
+	})
+	receiveEnviron(t, updateCh)
+
+	server.RevokeToken("child-1")
+	if err := tokens.checkChild(); err != nil {
+		t.Fatalf("unexpected error checking child token: %v", err)
+	}
+
+	receiveEnviron(t, updateCh)
+	waitForRevoked(t, server, 1)
+
+	// The lease belongs to the token that fetched it, and is revoked along
+	// with it, so it must be fetched again before the old token is revoked
+	fetchedAt, revokedAt := -1, -1
+	for idx, r := range server.Requests("/") {
+		if r.Path == "/v1/database/creds/app" && r.Token == "child-2" && fetchedAt == -1 {
+			fetchedAt = idx
+		} else if r.Path == "/v1/auth/token/revoke-accessor" && r.Body["accessor"] == "accessor-1" {
+			revokedAt = idx
+		}
+	}
+
+	if fetchedAt == -1 || revokedAt == -1 || fetchedAt > revokedAt {
+		t.Errorf("expected the lease to be fetched with the new child token before the old one was revoked, got: %v", server.Requests("/").Tokens())
+	}
+}
+
+func TestTokenManagerKeepsChildWhenRotationFails(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unwrapToken := false
+	tokens, _ := startTestTokenManager(t, ctx, server, &Config{
+		AuthMethod:  AuthMethodToken,
+		UnwrapToken: &unwrapToken,
+		VaultToken:  "parent-token",
+	})
+
+	// Both the attempt with the current parent token and the one after
+	// authenticating again fail
+	server.Fail("/v1/auth/token/create", 2)
+	if err := tokens.childDone(); err == nil {
+		t.Fatalf("expected error when no child token could be created")
+	}
+
+	if _, err := tokens.client.LookupSelf(); err != nil {
+		t.Fatalf("unexpected error looking up token: %v", err)
+	}
+
+	lookups := server.Requests("/v1/auth/token/lookup-self").Tokens()
+	if token := lookups[len(lookups)-1]; token != "child-1" {
+		t.Errorf("expected the client to be switched back to the previous child token, got: %s", token)
+	}
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Cache stores the last template context built from Vault in an encrypted
+// file, so that vault-init can start the child while Vault is unreachable.
+type Cache struct {
+	path         string
+	aead         cipher.AEAD
+	maxStaleness time.Duration
+}
+
+// Entry is the plaintext of a cache file. The time it was saved at is
+// encrypted along with the context, so it can not be altered on disk.
+type Entry struct {
+	SavedAt time.Time              `json:"saved_at"`
+	Context map[string]interface{} `json:"context"`
+
+	// Plaintexts maps transit key and ciphertext to the plaintext of the
+	// values templates decrypted, so that they render without Vault
+	Plaintexts map[string]map[string]string `json:"plaintexts,omitempty"`
+}
+
+// New creates a cache stored at the given path. The AES-256-GCM key is
+// derived from the key material with SHA-256. Cached contexts older than
+// maxStaleness are refused.
+func New(path string, key []byte, maxStaleness time.Duration) (*Cache, error) {
+	if len(key) == 0 {
+		return nil, errors.New("cache key is empty")
+	}
+
+	derived := sha256.Sum256(key)
+	block, err := aes.NewCipher(derived[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cache cipher")
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create cache cipher")
+	}
+
+	return &Cache{
+		path:         path,
+		aead:         aead,
+		maxStaleness: maxStaleness,
+	}, nil
+}
+
+// Save encrypts the template context, along with the values decrypted while
+// rendering it, and replaces the cache file with it.
+func (c *Cache) Save(context map[string]interface{}, plaintexts map[string]map[string]string) error {
+	plaintext, err := json.Marshal(&Entry{
+		SavedAt:    time.Now(),
+		Context:    context,
+		Plaintexts: plaintexts,
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not encode template context")
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return errors.Wrap(err, "could not generate nonce")
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, plaintext, nil)
+
+	// Write to a temporary file first, so that a crash never leaves a
+	// partially written cache behind
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return errors.Wrapf(err, "could not create temporary cache file next to: %s", c.path)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "could not write cache file: %s", tmp.Name())
+	}
+
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "could not write cache file: %s", tmp.Name())
+	}
+
+	if err := os.Rename(tmp.Name(), c.path); err != nil {
+		return errors.Wrapf(err, "could not replace cache file: %s", c.path)
+	}
+
+	log.WithField("cachePath", c.path).Debugf("Saved template context to cache")
+
+	return nil
+}
+
+// Load decrypts the cached template context. Returns an error if there is
+// no cache, it can not be decrypted, or it is older than the max staleness.
+func (c *Cache) Load() (*Entry, error) {
+	sealed, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read cache file: %s", c.path)
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.Errorf("cache file `%s` is truncated", c.path)
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decrypt cache file `%s`; was the key changed?", c.path)
+	}
+
+	// Keep numbers as they were read from Vault, instead of as floats
+	decoder := json.NewDecoder(bytes.NewReader(plaintext))
+	decoder.UseNumber()
+
+	cached := &Entry{}
+	if err := decoder.Decode(cached); err != nil {
+		return nil, errors.Wrapf(err, "could not decode cache file: %s", c.path)
+	}
+
+	if age := time.Since(cached.SavedAt); age > c.maxStaleness {
+		return nil, errors.Errorf("cached template context is %s old, more than the max staleness of %s", age.Round(time.Second), c.maxStaleness)
+	}
+
+	return cached, nil
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T, key string, maxStaleness time.Duration) (*Cache, string) {
+	path := filepath.Join(t.TempDir(), "context.cache")
+	cache, err := New(path, []byte(key), maxStaleness)
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+
+	return cache, path
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	cache, path := newTestCache(t, "cache-key", time.Hour)
+
+	context := map[string]interface{}{
+		"secret": map[string]interface{}{
+			"password": "hunter2",
+			"port":     json.Number("5432"),
+		},
+	}
+
+	plaintexts := map[string]map[string]string{"app": {"vault:v1:abcd": "decrypted"}}
+	if err := cache.Save(context, plaintexts); err != nil {
+		t.Fatalf("unexpected error saving cache: %v", err)
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read cache file: %v", err)
+	}
+
+	if strings.Contains(string(contents), "hunter2") || strings.Contains(string(contents), "decrypted") {
+		t.Errorf("expected cache file to be encrypted, got: %s", contents)
+	}
+
+	loaded, err := cache.Load()
+	if err != nil {
+		t.Fatalf("unexpected error loading cache: %v", err)
+	}
+
+	secret := loaded.Context["secret"].(map[string]interface{})
+	if secret["password"] != "hunter2" || secret["port"] != json.Number("5432") {
+		t.Errorf("expected cached context to be loaded as saved, got: %v", loaded.Context)
+	}
+
+	if loaded.Plaintexts["app"]["vault:v1:abcd"] != "decrypted" {
+		t.Errorf("expected cached plaintexts to be loaded as saved, got: %v", loaded.Plaintexts)
+	}
+}
+
+func TestCacheLoadRefusesWrongKeyAndStale(t *testing.T) {
+	cache, path := newTestCache(t, "cache-key", time.Hour)
+
+	if err := cache.Save(map[string]interface{}{"key": "value"}, nil); err != nil {
+		t.Fatalf("unexpected error saving cache: %v", err)
+	}
+
+	otherKey, err := New(path, []byte("other-key"), time.Hour)
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+
+	if _, err := otherKey.Load(); err == nil {
+		t.Errorf("expected error loading cache with a different key")
+	}
+
+	stale, err := New(path, []byte("cache-key"), 0)
+	if err != nil {
+		t.Fatalf("could not create cache: %v", err)
+	}
+
+	if _, err := stale.Load(); err == nil || !strings.Contains(err.Error(), "max staleness") {
+		t.Errorf("expected error loading cache older than the max staleness, got: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+package secret
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// IsCertificate returns true if the secret holds an issued certificate along
+// with its private key, as returned by the PKI secrets engine.
+func (s *Secret) IsCertificate() bool {
+	if s.Secret == nil || s.Data == nil {
+		return false
+	}
+
+	_, hasCertificate := s.Data["certificate"].(string)
+	_, hasPrivateKey := s.Data["private_key"].(string)
+
+	return hasCertificate && hasPrivateKey
+}
+
+// CertificateRenewAt returns when the certificate held by the secret should
+// be issued again, after the given fraction of its lifetime has passed.
+func (s *Secret) CertificateRenewAt(fraction float64) (time.Time, error) {
+	certPEM, _ := s.Data["certificate"].(string)
+
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return time.Time{}, errors.Errorf("secret `%s` does not hold a PEM encoded certificate", s.Path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "could not parse certificate in secret `%s`", s.Path)
+	}
+
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * fraction)), nil
+}
@@ -0,0 +1,38 @@
+package secret_test
+
+import (
+	"testing"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func TestCertificateRenewAt(t *testing.T) {
+	notBefore := time.Now().Add(-time.Hour).Truncate(time.Second)
+	sec := secret.New("pki/issue/web", &vaultApi.Secret{
+		Data: map[string]interface{}{
+			"certificate": vaulttest.IssueCertificate(t, notBefore, notBefore.Add(10*time.Hour)),
+			"private_key": "key",
+		},
+	})
+
+	if !sec.IsCertificate() {
+		t.Fatalf("expected secret with certificate and private key to be a certificate")
+	}
+
+	renewAt, err := sec.CertificateRenewAt(0.7)
+	if err != nil {
+		t.Fatalf("unexpected error getting certificate renewal time: %v", err)
+	}
+
+	if expected := notBefore.Add(7 * time.Hour); !renewAt.Equal(expected) {
+		t.Errorf("expected certificate to be renewed at %s, got: %s", expected, renewAt)
+	}
+
+	if secret.New("secret/shared", &vaultApi.Secret{Data: map[string]interface{}{"certificate": "cert"}}).IsCertificate() {
+		t.Errorf("expected secret without private key not to be a certificate")
+	}
+}
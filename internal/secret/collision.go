@@ -0,0 +1,140 @@
+package secret
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CollisionPolicy decides what happens when two secrets put different values
+// under the same key of the template context.
+type CollisionPolicy string
+
+const (
+	// CollisionError refuses to build the context.
+	CollisionError CollisionPolicy = "error"
+
+	// CollisionFirstWins keeps the value of the secret listed first.
+	CollisionFirstWins CollisionPolicy = "first-wins"
+
+	// CollisionLastWins keeps the value of the secret listed last.
+	CollisionLastWins CollisionPolicy = "last-wins"
+)
+
+// Validate checks that the collision policy is known.
+func (p CollisionPolicy) Validate() error {
+	switch p {
+	case CollisionError, CollisionFirstWins, CollisionLastWins:
+		return nil
+	default:
+		return errors.Errorf("unknown collision policy `%s`", p)
+	}
+}
+
+// contextMerger merges secrets into a template context, remembering which
+// secret each key came from so that collisions can be reported.
+type contextMerger struct {
+	policy CollisionPolicy
+
+	// sources maps the dotted key of every value in the context to the
+	// `--path` entry of the secret it came from
+	sources map[string]string
+}
+
+func newContextMerger(policy CollisionPolicy) *contextMerger {
+	return &contextMerger{
+		policy:  policy,
+		sources: make(map[string]string, 0),
+	}
+}
+
+// merge merges src, which came from the given source, into dst. Maps present
+// in both are merged; any other value present in both is a collision.
+func (m *contextMerger) merge(dst, src map[string]interface{}, source string, parents []string) error {
+	for key, value := range src {
+		keyPath := append(append([]string{}, parents...), key)
+		dottedKey := strings.Join(keyPath, ".")
+
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = copyContextValue(value)
+			m.sources[dottedKey] = source
+			continue
+		}
+
+		existingMap, existingIsMap := existing.(map[string]interface{})
+		valueMap, valueIsMap := value.(map[string]interface{})
+		if existingIsMap && valueIsMap {
+			if err := m.merge(existingMap, valueMap, source, keyPath); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if reflect.DeepEqual(existing, value) {
+			continue
+		}
+
+		previous := m.sourceOf(keyPath)
+		logger := log.WithFields(logrus.Fields{
+			"key":         dottedKey,
+			"firstSource": previous,
+			"lastSource":  source,
+			"policy":      m.policy,
+		})
+
+		switch m.policy {
+		case CollisionError:
+			return errors.Errorf("secrets `%s` and `%s` both set key `%s`", previous, source, dottedKey)
+		case CollisionLastWins:
+			logger.Warnf("Secrets collide on key; keeping the value of the last secret")
+			dst[key] = copyContextValue(value)
+			m.forget(dottedKey)
+			m.sources[dottedKey] = source
+		default:
+			logger.Warnf("Secrets collide on key; keeping the value of the first secret")
+		}
+	}
+
+	return nil
+}
+
+// sourceOf returns the source of the value at the given key. Values that were
+// added along with a whole map are found by the key of that map.
+func (m *contextMerger) sourceOf(keyPath []string) string {
+	for idx := len(keyPath); idx > 0; idx-- {
+		if source, ok := m.sources[strings.Join(keyPath[:idx], ".")]; ok {
+			return source
+		}
+	}
+
+	return ""
+}
+
+// forget drops the sources of a key and everything below it.
+func (m *contextMerger) forget(dottedKey string) {
+	for key := range m.sources {
+		if key == dottedKey || strings.HasPrefix(key, dottedKey+".") {
+			delete(m.sources, key)
+		}
+	}
+}
+
+// copyContextValue copies the maps in a value, so that merging other secrets
+// into the context never modifies the data of a secret.
+func copyContextValue(value interface{}) interface{} {
+	valueMap, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+
+	copied := make(map[string]interface{}, len(valueMap))
+	for key, inner := range valueMap {
+		copied[key] = copyContextValue(inner)
+	}
+
+	return copied
+}
@@ -0,0 +1,74 @@
+package secret
+
+import (
+	"strings"
+	"testing"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+func newCollisionTestSecrets(t *testing.T) []*Secret {
+	first, err := ParseSpec("db=database/creds/app")
+	if err != nil {
+		t.Fatalf("could not parse spec: %v", err)
+	}
+
+	last, err := ParseSpec("db=secret/legacy/db")
+	if err != nil {
+		t.Fatalf("could not parse spec: %v", err)
+	}
+
+	return []*Secret{
+		NewFromSpec(first, &vaultApi.Secret{
+			Data: map[string]interface{}{"username": "app", "password": "first"},
+		}),
+		NewFromSpec(last, &vaultApi.Secret{
+			Data: map[string]interface{}{"username": "app", "password": "last", "host": "db"},
+		}),
+	}
+}
+
+func TestSecretsAsMapCollisions(t *testing.T) {
+	cases := []struct {
+		policy   CollisionPolicy
+		password string
+	}{
+		{CollisionFirstWins, "first"},
+		{CollisionLastWins, "last"},
+	}
+
+	for _, c := range cases {
+		data, err := SecretsAsMap(newCollisionTestSecrets(t), NestingFullPath, c.policy)
+		if err != nil {
+			t.Errorf("%s: unexpected error building data map: %v", c.policy, err)
+			continue
+		}
+
+		db := data["db"].(map[string]interface{})
+		if db["password"] != c.password || db["host"] != "db" || db["username"] != "app" {
+			t.Errorf("%s: expected password '%s' with other keys merged, got: %v", c.policy, c.password, db)
+		}
+	}
+
+	_, err := SecretsAsMap(newCollisionTestSecrets(t), NestingFullPath, CollisionError)
+	if err == nil {
+		t.Fatalf("expected error for colliding secrets")
+	}
+
+	for _, expected := range []string{"db=database/creds/app", "db=secret/legacy/db", "db.password"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected collision error to mention `%s`, got: %v", expected, err)
+		}
+	}
+}
+
+func TestSecretsAsMapKeepsSecretData(t *testing.T) {
+	secrets := newCollisionTestSecrets(t)
+	if _, err := SecretsAsMap(secrets, NestingFullPath, CollisionLastWins); err != nil {
+		t.Fatalf("unexpected error building data map: %v", err)
+	}
+
+	if secrets[0].Data["password"] != "first" || secrets[0].Data["host"] != nil {
+		t.Errorf("expected merging not to modify the data of a secret, got: %v", secrets[0].Data)
+	}
+}
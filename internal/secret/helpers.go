@@ -5,7 +5,6 @@ import (
 	"reflect"
 
 	vaultApi "github.com/hashicorp/vault/api"
-	"github.com/imdario/mergo"
 	"github.com/pkg/errors"
 )
 
@@ -68,11 +67,29 @@ func CompareSecretData(current, next *vaultApi.Secret) (bool, error) {
 	return !reflect.DeepEqual(current, next), nil
 }
 
-func SecretsAsMap(secrets []*Secret) (map[string]interface{}, error) {
+// SecretsAsMap merges the data of all secrets into a single template context,
+// nesting each secret's data under keys chosen by the nesting strategy. Keys
+// set by more than one secret are resolved by the collision policy.
+func SecretsAsMap(secrets []*Secret, nesting ContextNesting, collisions CollisionPolicy) (map[string]interface{}, error) {
+	stripped, err := nesting.strippedKeys(secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := collisions.Validate(); err != nil {
+		return nil, err
+	}
+
 	data := make(map[string]interface{}, 0)
+	merger := newContextMerger(collisions)
 
 	for _, secret := range secrets {
-		if err := mergo.Merge(&data, secret.dataMap()); err != nil {
+		keys := secret.contextKeys()
+		if !secret.aliased() {
+			keys = keys[stripped:]
+		}
+
+		if err := merger.merge(data, nestData(keys, secret.contextData()), secret.Source(), nil); err != nil {
 			return nil, errors.Wrap(err, "could not merge secret to data")
 		}
 	}
@@ -0,0 +1,80 @@
+package secret
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ContextNesting is a strategy for choosing the keys each secret's data is
+// nested under in the template context.
+type ContextNesting string
+
+const (
+	// NestingFullPath nests each secret's data under every component of its
+	// path, such as `.secret.data.services.concourse`.
+	NestingFullPath ContextNesting = "full-path"
+
+	// NestingSharedAncestry strips the path components all secrets have in
+	// common and nests each secret's data under the rest. The data of a single
+	// secret becomes the top level of the context.
+	NestingSharedAncestry ContextNesting = "shared-ancestry"
+)
+
+// Validate checks that the nesting strategy is known.
+func (n ContextNesting) Validate() error {
+	switch n {
+	case NestingFullPath, NestingSharedAncestry:
+		return nil
+	default:
+		return errors.Errorf("unknown context nesting `%s`", n)
+	}
+}
+
+// strippedKeys returns the number of leading path components that are left
+// out of the context keys of every secret. Aliased secrets keep their alias
+// and do not count towards the shared ancestry.
+func (n ContextNesting) strippedKeys(secrets []*Secret) (int, error) {
+	if err := n.Validate(); err != nil {
+		return 0, err
+	}
+
+	if n != NestingSharedAncestry {
+		return 0, nil
+	}
+
+	var shared []string
+	count := 0
+	for _, sec := range secrets {
+		if sec.aliased() {
+			continue
+		}
+
+		keys := sec.contextKeys()
+		if count == 0 {
+			shared = keys
+		} else {
+			shared = sharedPrefix(shared, keys)
+		}
+
+		count++
+	}
+
+	// With a single secret, all of its keys are shared, so its data becomes
+	// the top level of the context
+	return len(shared), nil
+}
+
+// sharedPrefix returns the leading keys a and b have in common. Always leaves
+// at least one key of each, so that secrets stay apart in the context.
+func sharedPrefix(a, b []string) []string {
+	limit := len(a)
+	if len(b) < limit {
+		limit = len(b)
+	}
+
+	idx := 0
+	for idx < limit-1 && a[idx] == b[idx] {
+		idx++
+	}
+
+	return a[:idx]
+}
@@ -0,0 +1,111 @@
+package secret
+
+import (
+	"reflect"
+	"testing"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+func newNestingTestSecrets(t *testing.T, paths ...string) []*Secret {
+	secrets := make([]*Secret, 0)
+	for _, raw := range paths {
+		spec, err := ParseSpec(raw)
+		if err != nil {
+			t.Fatalf("could not parse spec `%s`: %v", raw, err)
+		}
+
+		secrets = append(secrets, NewFromSpec(spec, &vaultApi.Secret{
+			Data: map[string]interface{}{"some_value": raw},
+		}))
+	}
+
+	return secrets
+}
+
+func TestSecretsAsMapSharedAncestry(t *testing.T) {
+	cases := []struct {
+		name     string
+		paths    []string
+		expected map[string]interface{}
+	}{
+		{
+			name:  "single path becomes the top level",
+			paths: []string{"/secret/data/services/concourse"},
+			expected: map[string]interface{}{
+				"some_value": "/secret/data/services/concourse",
+			},
+		},
+		{
+			name:  "shared ancestry is stripped",
+			paths: []string{"/secret/data/services/concourse", "/secret/data/services/sourcegraph"},
+			expected: map[string]interface{}{
+				"concourse":   map[string]interface{}{"some_value": "/secret/data/services/concourse"},
+				"sourcegraph": map[string]interface{}{"some_value": "/secret/data/services/sourcegraph"},
+			},
+		},
+		{
+			name:  "paths without shared ancestry keep their full path",
+			paths: []string{"/secret/data/services/concourse", "/kv1/services/haproxy"},
+			expected: map[string]interface{}{
+				"secret": map[string]interface{}{
+					"data": map[string]interface{}{
+						"services": map[string]interface{}{
+							"concourse": map[string]interface{}{"some_value": "/secret/data/services/concourse"},
+						},
+					},
+				},
+				"kv1": map[string]interface{}{
+					"services": map[string]interface{}{
+						"haproxy": map[string]interface{}{"some_value": "/kv1/services/haproxy"},
+					},
+				},
+			},
+		},
+		{
+			name:  "aliases do not count towards the shared ancestry",
+			paths: []string{"/secret/data/services/concourse", "db=database/creds/app"},
+			expected: map[string]interface{}{
+				"some_value": "/secret/data/services/concourse",
+				"db":         map[string]interface{}{"some_value": "db=database/creds/app"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		data, err := SecretsAsMap(newNestingTestSecrets(t, c.paths...), NestingSharedAncestry, CollisionFirstWins)
+		if err != nil {
+			t.Errorf("%s: unexpected error building data map: %v", c.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(data, c.expected) {
+			t.Errorf("%s: expected %v, got: %v", c.name, c.expected, data)
+		}
+	}
+}
+
+func TestSecretsAsMapFullPath(t *testing.T) {
+	data, err := SecretsAsMap(newNestingTestSecrets(t, "/secret/data/services/concourse"), NestingFullPath, CollisionFirstWins)
+	if err != nil {
+		t.Fatalf("unexpected error building data map: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"secret": map[string]interface{}{
+			"data": map[string]interface{}{
+				"services": map[string]interface{}{
+					"concourse": map[string]interface{}{"some_value": "/secret/data/services/concourse"},
+				},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected full path nesting %v, got: %v", expected, data)
+	}
+
+	if _, err := SecretsAsMap(nil, ContextNesting("flat"), CollisionFirstWins); err == nil {
+		t.Errorf("expected error for unknown context nesting")
+	}
+}
@@ -1,7 +1,9 @@
 package secret
 
 import (
+	"path"
 	"strings"
+	"sync"
 
 	"github.com/davecgh/go-spew/spew"
 	vaultApi "github.com/hashicorp/vault/api"
@@ -13,10 +15,26 @@ type Secret struct {
 	*vaultApi.Secret
 
 	// renewer is a reference to the running vaultApi.Renewer
-	renewer *vaultApi.Renewer
+	renewer     *vaultApi.Renewer
+	renewerLock sync.Mutex
 
 	// Path is the logical path at which this secret was found
 	Path string
+
+	// Spec is the parsed `--path` entry this secret was loaded from, if any
+	Spec *Spec
+
+	// KVv2 marks secrets read from a KV version 2 mount. Their key/values
+	// are exposed without the `data` nesting of the KV v2 API.
+	KVv2 bool
+}
+
+// NewMissing creates an empty placeholder for an optional secret that does
+// not exist, so that templates can test for it.
+func NewMissing(spec *Spec) *Secret {
+	return NewFromSpec(spec, &vaultApi.Secret{
+		Data: make(map[string]interface{}, 0),
+	})
 }
 
 // WrapChildToken wraps a special-case token that is injected into the child program.
@@ -33,6 +51,35 @@ func New(path string, secret *vaultApi.Secret) *Secret {
 	}
 }
 
+// NewFromSpec creates an instance of a Secret wrapped from the Vault API,
+// which was loaded from the given `--path` entry.
+func NewFromSpec(spec *Spec, secret *vaultApi.Secret) *Secret {
+	sec := New(spec.Path, secret)
+	sec.Spec = spec
+
+	return sec
+}
+
+// Source returns the `--path` entry the secret was loaded from, which can be
+// used to fetch it again.
+func (s *Secret) Source() string {
+	if s.Spec != nil {
+		return s.Spec.Raw
+	}
+
+	return s.Path
+}
+
+// IsWrite returns true if the secret was loaded with a write-style request.
+func (s *Secret) IsWrite() bool {
+	return s.Spec != nil && s.Spec.IsWrite()
+}
+
+// Pinned returns true if the secret was loaded from a specific, pinned version.
+func (s *Secret) Pinned() bool {
+	return s.Spec != nil && s.Spec.Pinned()
+}
+
 // IsRenewable detemines if the secret is renewable.
 func (s *Secret) IsRenewable() (bool, error) {
 	var authRenewable bool
@@ -49,6 +96,11 @@ func (s *Secret) IsRenewable() (bool, error) {
 		authRenewable = false
 	}
 
+	// Leased secrets, such as dynamic credentials, carry their own flag
+	if s.LeaseID != "" && s.Renewable {
+		leaseRenewable = true
+	}
+
 	return authRenewable || leaseRenewable, nil
 }
 
@@ -59,6 +111,11 @@ func (s *Secret) Update(nextSecret *Secret) (bool, error) {
 	hasChanged := false
 	var err error
 
+	// Pinned versions are frozen
+	if s.Pinned() {
+		return false, nil
+	}
+
 	if HasMetadata(s.Secret) && HasMetadata(nextSecret.Secret) {
 		hasChanged, err = CompareSecretMetadata(s.Secret, nextSecret.Secret)
 		if err != nil {
@@ -72,55 +129,190 @@ func (s *Secret) Update(nextSecret *Secret) (bool, error) {
 	}
 
 	if hasChanged {
-		s.Secret = nextSecret.Secret
+		s.Replace(nextSecret)
 	}
 
 	return hasChanged, nil
 }
 
+// Replace replaces the secret's contents with those of a newer fetch of the
+// same `--path` entry.
+func (s *Secret) Replace(nextSecret *Secret) {
+	s.Secret = nextSecret.Secret
+	s.Path = nextSecret.Path
+	s.KVv2 = nextSecret.KVv2
+}
+
 // GetRenewer returns the associated renewer.
 func (s *Secret) GetRenewer() *vaultApi.Renewer {
+	s.renewerLock.Lock()
+	defer s.renewerLock.Unlock()
+
 	return s.renewer
 }
 
-func (s *Secret) dataMap() map[string]interface{} {
-	data := s.Data
-	pathComponents := strings.Split(s.Path, "/")
-	for idx := range pathComponents {
-		component := pathComponents[len(pathComponents)-1-idx]
+// SetRenewer associates a renewer with the secret. Should be called before
+// the renewer is watched, so that it can be stopped right away.
+func (s *Secret) SetRenewer(renewer *vaultApi.Renewer) {
+	s.renewerLock.Lock()
+	defer s.renewerLock.Unlock()
+
+	s.renewer = renewer
+}
+
+// contextData returns the data of the secret as it is exposed in the template
+// context.
+func (s *Secret) contextData() map[string]interface{} {
+	if s.KVv2 {
+		data, _ := s.Data["data"].(map[string]interface{})
+		return data
+	}
+
+	return s.Data
+}
+
+// aliased returns true if the secret is put under an alias in the template
+// context, instead of under its path.
+func (s *Secret) aliased() bool {
+	return s.Spec != nil && s.Spec.Alias != ""
+}
+
+// contextKeys returns the keys the secret's data is nested under in the
+// template context: its alias, or the components of its path.
+func (s *Secret) contextKeys() []string {
+	if s.aliased() {
+		return strings.Split(s.Spec.Alias, ".")
+	}
+
+	contextPath := s.Path
+	if s.Spec != nil {
+		// Keep secrets from different namespaces apart in the context
+		contextPath = path.Join(s.Spec.Namespace, s.Path)
+	}
+
+	keys := make([]string, 0)
+	for _, component := range strings.Split(contextPath, "/") {
 		if component == "" {
 			// Skip blank components
 			continue
 		}
 
-		component = strings.ReplaceAll(component, "-", "_")
+		keys = append(keys, strings.ReplaceAll(component, "-", "_"))
+	}
+
+	return keys
+}
 
+// nestData nests data under the given keys, outermost key first.
+func nestData(keys []string, data map[string]interface{}) map[string]interface{} {
+	for idx := range keys {
 		tmp := make(map[string]interface{}, 0)
-		tmp[component] = data
+		tmp[keys[len(keys)-1-idx]] = data
 		data = tmp
 	}
 
 	return data
 }
 
-// WatchRenewer starts the renewer watcher for this secret.
-func (s *Secret) WatchRenewer(renewer *vaultApi.Renewer) {
-	log.Debugf("Watching renewer for secret `%s`", s.Path)
-	s.renewer = renewer
+// Renewal is a renewal of a secret's lease. Renewers never write to the
+// secret themselves; the goroutine that owns the secret applies the renewal.
+type Renewal struct {
+	Secret *Secret
+
+	renewer  *vaultApi.Renewer
+	response *vaultApi.Secret
+}
+
+// Apply updates the lease of the secret from the renewal, unless the renewer
+// that sent it was stopped or replaced since. Returns whether it was applied.
+func (r *Renewal) Apply() bool {
+	if r.Secret.GetRenewer() != r.renewer {
+		return false
+	}
+
+	r.Secret.applyRenewal(r.response)
 
+	return true
+}
+
+// WatchRenewer starts watching the renewer of this secret in the background.
+// Renewals are sent to renewedCh. If the renewer finishes on its own, because
+// the lease can no longer be renewed, the secret is sent to expiredCh.
+// Renewers that were stopped or replaced are not. Once done is closed, the
+// owner of the secret is no longer listening and nothing is sent.
+func (s *Secret) WatchRenewer(renewer *vaultApi.Renewer, done <-chan struct{}, renewedCh chan<- *Renewal, expiredCh chan<- *Secret) {
+	// The secret may be replaced while the renewer runs, so its path is
+	// only read here
+	secretPath := s.Path
+	log.Debugf("Watching renewer for secret `%s`", secretPath)
+
+	go s.watchRenewer(secretPath, renewer, done, renewedCh, expiredCh)
+}
+
+func (s *Secret) watchRenewer(secretPath string, renewer *vaultApi.Renewer, done <-chan struct{}, renewedCh chan<- *Renewal, expiredCh chan<- *Secret) {
 	for {
+		var err error
+
 		select {
-		case err := <-renewer.DoneCh():
-			if err != nil {
-				log.WithError(err).WithField("secretPath", s.Path).Errorf("Renewer finished with an error")
+		case err = <-renewer.DoneCh():
+		case output := <-renewer.RenewCh():
+			if renewedCh == nil {
+				continue
+			}
+
+			renewal := &Renewal{
+				Secret:   s,
+				renewer:  renewer,
+				response: output.Secret,
 			}
 
-			log.WithField("secretPath", s.Path).Debugf("Renewer finished cleanly")
+			// Do not wait on the owner of the secret once the renewer has
+			// finished, since it may no longer be listening
+			select {
+			case renewedCh <- renewal:
+				log.Debugf("Renewer renewed secret `%s`", secretPath)
+				continue
+			case err = <-renewer.DoneCh():
+			case <-done:
+				return
+			}
+		}
+
+		if err != nil {
+			log.WithError(err).WithField("secretPath", secretPath).Errorf("Renewer finished with an error")
+		}
+
+		log.WithField("secretPath", secretPath).Debugf("Renewer finished cleanly")
+
+		// Only forget the renewer if it was not replaced in the meantime
+		s.renewerLock.Lock()
+		expired := s.renewer == renewer
+		if expired {
 			s.renewer = nil
-			return
-		case output := <-renewer.RenewCh():
-			s.Secret = output.Secret
-			log.Debugf("Renewer updated secret `%s`", s.Path)
 		}
+		s.renewerLock.Unlock()
+
+		if expired && expiredCh != nil {
+			select {
+			case expiredCh <- s:
+			case <-done:
+			}
+		}
+
+		return
+	}
+}
+
+// applyRenewal updates the lease of the secret from a renewal response. The
+// response usually does not carry the secret's data, so the data is kept.
+func (s *Secret) applyRenewal(renewal *vaultApi.Secret) {
+	next := *s.Secret
+	next.LeaseDuration = renewal.LeaseDuration
+	next.Renewable = renewal.Renewable
+
+	if renewal.Auth != nil {
+		next.Auth = renewal.Auth
 	}
+
+	s.Secret = &next
 }
@@ -0,0 +1,94 @@
+package secret
+
+import (
+	"testing"
+
+	vaultApi "github.com/hashicorp/vault/api"
+)
+
+func TestLeasedSecretIsRenewable(t *testing.T) {
+	sec := New("database/creds/app", &vaultApi.Secret{
+		LeaseID:       "database/creds/app/abcd",
+		LeaseDuration: 3600,
+		Renewable:     true,
+		Data:          map[string]interface{}{"username": "app"},
+	})
+
+	renewable, err := sec.IsRenewable()
+	if err != nil {
+		t.Fatalf("unexpected error checking renewability: %v", err)
+	}
+
+	if !renewable {
+		t.Errorf("expected renewable leased secret to be renewable")
+	}
+}
+
+func TestApplyRenewalKeepsData(t *testing.T) {
+	sec := New("database/creds/app", &vaultApi.Secret{
+		LeaseID:       "database/creds/app/abcd",
+		LeaseDuration: 60,
+		Renewable:     true,
+		Data:          map[string]interface{}{"username": "app"},
+	})
+
+	sec.applyRenewal(&vaultApi.Secret{
+		LeaseID:       "database/creds/app/abcd",
+		LeaseDuration: 3600,
+		Renewable:     false,
+	})
+
+	if sec.LeaseDuration != 3600 || sec.Renewable {
+		t.Errorf("expected lease to be updated from renewal, got: %d, %v", sec.LeaseDuration, sec.Renewable)
+	}
+
+	if sec.Data["username"] != "app" {
+		t.Errorf("expected secret data to be kept after renewal, got: %v", sec.Data)
+	}
+}
+
+func TestRenewalApplyIgnoresReplacedRenewer(t *testing.T) {
+	sec := New("database/creds/app", &vaultApi.Secret{
+		LeaseID:       "database/creds/app/abcd",
+		LeaseDuration: 60,
+		Renewable:     true,
+	})
+
+	previous, current := &vaultApi.Renewer{}, &vaultApi.Renewer{}
+	sec.SetRenewer(current)
+
+	stale := &Renewal{Secret: sec, renewer: previous, response: &vaultApi.Secret{LeaseDuration: 10}}
+	if stale.Apply() || sec.LeaseDuration != 60 {
+		t.Errorf("expected renewal from a replaced renewer not to be applied, got lease duration: %d", sec.LeaseDuration)
+	}
+
+	renewal := &Renewal{Secret: sec, renewer: current, response: &vaultApi.Secret{LeaseDuration: 3600, Renewable: true}}
+	if !renewal.Apply() || sec.LeaseDuration != 3600 {
+		t.Errorf("expected renewal from the current renewer to be applied, got lease duration: %d", sec.LeaseDuration)
+	}
+}
+
+func TestSecretsAsMapAlias(t *testing.T) {
+	spec, err := ParseSpec("app.db=database/creds/app")
+	if err != nil {
+		t.Fatalf("unexpected error parsing spec: %v", err)
+	}
+
+	sec := NewFromSpec(spec, &vaultApi.Secret{
+		Data: map[string]interface{}{"password": "hunter2"},
+	})
+
+	data, err := SecretsAsMap([]*Secret{sec}, NestingFullPath, CollisionFirstWins)
+	if err != nil {
+		t.Fatalf("unexpected error building data map: %v", err)
+	}
+
+	db, ok := data["app"].(map[string]interface{})["db"].(map[string]interface{})
+	if !ok || db["password"] != "hunter2" {
+		t.Errorf("expected secret data under .app.db, got: %v", data)
+	}
+
+	if _, ok := data["database"]; ok {
+		t.Errorf("expected aliased secret not to be nested under its path, got: %v", data)
+	}
+}
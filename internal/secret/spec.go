@@ -0,0 +1,249 @@
+package secret
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// namespaceSeparator separates the namespace prefix from the secret path
+// in a `--path` entry.
+const namespaceSeparator = "::"
+
+// optionalMarker marks a `--path` entry as optional. Missing optional secrets
+// are put into the context as an empty entry; missing required ones are errors.
+const optionalMarker = "?"
+
+// aliasPattern matches the `alias=` prefix of a `--path` entry. Aliases are
+// identifiers, optionally nested with dots.
+var aliasPattern = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*(?:\.[A-Za-z_][A-Za-z0-9_]*)*)=`)
+
+// aliasUnsafeChars matches the characters of a listed key that can not be used
+// in an alias.
+var aliasUnsafeChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// methodSeparator separates the HTTP method from the rest of a `--path` entry.
+const methodSeparator = ":"
+
+// paramsSeparator separates the request parameters from the secret path in a
+// `--path` entry.
+const paramsSeparator = "?"
+
+// requestMethods are the HTTP methods a `--path` entry may name.
+var requestMethods = map[string]bool{
+	http.MethodGet:  true,
+	http.MethodPost: true,
+	http.MethodPut:  true,
+}
+
+// wildcardChars are the glob characters that make a path segment a wildcard.
+const wildcardChars = "*["
+
+// versionSeparator separates the pinned KV v2 version from the secret path
+// in a `--path` entry.
+const versionSeparator = "@"
+
+// Spec describes a secret that should be loaded into the template context,
+// as parsed from a `--path` entry.
+type Spec struct {
+	// Raw is the unparsed `--path` entry. For secrets matched by a wildcard,
+	// it only describes the match and is not parsed again.
+	Raw string
+
+	// Optional is set if the secret may be missing
+	Optional bool
+
+	// Alias is the key the secret's data is put under in the template
+	// context, instead of its path components
+	Alias string
+
+	// Namespace is the Vault Enterprise namespace the secret is read from,
+	// relative to the client's namespace
+	Namespace string
+
+	// Path is the logical path of the secret inside of its namespace
+	Path string
+
+	// Version is the pinned KV v2 version of the secret, or 0 to follow the
+	// latest version
+	Version int
+
+	// Method is the HTTP method the secret is requested with; empty for GET
+	Method string
+
+	// Params are the request parameters sent along, as unrendered templates.
+	// Sent as the request body for writes and as the query string otherwise.
+	Params url.Values
+}
+
+// ParseSpec parses a `--path` entry of the form
+// `[?][alias=][METHOD:][namespace::]path[@version][?key=value&...]`. A suffix
+// after the last `@` is only taken as a version if it is numeric, so paths
+// containing `@` can still be read.
+func ParseSpec(raw string) (*Spec, error) {
+	spec := &Spec{
+		Raw:  raw,
+		Path: raw,
+	}
+
+	if strings.HasPrefix(spec.Path, optionalMarker) {
+		spec.Optional = true
+		spec.Path = spec.Path[len(optionalMarker):]
+	}
+
+	if match := aliasPattern.FindStringSubmatch(spec.Path); match != nil {
+		spec.Alias = match[1]
+		spec.Path = spec.Path[len(match[0]):]
+	}
+
+	if idx := strings.Index(spec.Path, methodSeparator); idx > 0 && !strings.HasPrefix(spec.Path[idx:], namespaceSeparator) {
+		if method := spec.Path[:idx]; requestMethods[method] {
+			spec.Method = method
+			spec.Path = spec.Path[idx+len(methodSeparator):]
+		}
+	}
+
+	if idx := strings.Index(spec.Path, paramsSeparator); idx >= 0 {
+		params, err := url.ParseQuery(spec.Path[idx+len(paramsSeparator):])
+		if err != nil {
+			return nil, errors.Wrapf(err, "path `%s` has invalid request parameters", raw)
+		}
+
+		spec.Params = params
+		spec.Path = spec.Path[:idx]
+	}
+
+	if idx := strings.Index(spec.Path, namespaceSeparator); idx >= 0 {
+		spec.Namespace = strings.Trim(spec.Path[:idx], "/")
+		spec.Path = spec.Path[idx+len(namespaceSeparator):]
+
+		if spec.Namespace == "" {
+			return nil, errors.Errorf("path `%s` has an empty namespace prefix", raw)
+		}
+	}
+
+	if idx := strings.LastIndex(spec.Path, versionSeparator); idx >= 0 && isNumeric(spec.Path[idx+1:]) {
+		version, err := strconv.Atoi(spec.Path[idx+1:])
+		if err != nil || version < 1 {
+			return nil, errors.Errorf("path `%s` pins an invalid version", raw)
+		}
+
+		spec.Version = version
+		spec.Path = spec.Path[:idx]
+	}
+
+	if strings.Trim(spec.Path, "/") == "" {
+		return nil, errors.Errorf("path `%s` does not name a secret", raw)
+	}
+
+	if spec.Pinned() && (spec.IsWrite() || len(spec.Params) > 0) {
+		return nil, errors.Errorf("path `%s` can not pin a version of a request with a method or parameters", raw)
+	}
+
+	if err := spec.validateWildcard(); err != nil {
+		return nil, errors.Wrapf(err, "path `%s` has an invalid wildcard", raw)
+	}
+
+	return spec, nil
+}
+
+// RequestPath returns the path the secret should be requested at. Vault
+// accepts the namespace as a prefix of the request path.
+func (s *Spec) RequestPath() string {
+	if s.Namespace == "" {
+		return s.Path
+	}
+
+	return path.Join(s.Namespace, s.Path)
+}
+
+// IsWrite returns true if the secret is requested with a write-style method.
+// Every write request may create a new secret, such as a certificate.
+func (s *Spec) IsWrite() bool {
+	return s.Method == http.MethodPost || s.Method == http.MethodPut
+}
+
+// Pinned returns true if the spec pins a specific version of the secret.
+func (s *Spec) Pinned() bool {
+	return s.Version > 0
+}
+
+// IsWildcard returns true if the last segment of the path is a glob pattern,
+// which matches the secrets listed under its parent path.
+func (s *Spec) IsWildcard() bool {
+	return strings.ContainsAny(path.Base(s.Path), wildcardChars)
+}
+
+// Expand returns the spec of the secret the wildcard matched with the given
+// key. The parent is the logical path the key was listed under. An alias of
+// the wildcard nests the key under it. Matched secrets are optional, since
+// they may go away before they are read. The key is never parsed, so keys
+// that look like a version, parameters or a method are read as listed.
+func (s *Spec) Expand(parent, key string) *Spec {
+	expanded := &Spec{
+		Optional:  true,
+		Namespace: s.Namespace,
+		Path:      path.Join(parent, key),
+	}
+
+	raw := expanded.Path
+	if s.Namespace != "" {
+		raw = s.Namespace + namespaceSeparator + raw
+	}
+
+	if s.Alias != "" {
+		aliasKey := aliasUnsafeChars.ReplaceAllString(key, "_")
+		if aliasKey[0] >= '0' && aliasKey[0] <= '9' {
+			aliasKey = "_" + aliasKey
+		}
+
+		expanded.Alias = s.Alias + "." + aliasKey
+		raw = expanded.Alias + "=" + raw
+	}
+
+	expanded.Raw = optionalMarker + raw
+
+	return expanded
+}
+
+// validateWildcard checks that only the last segment of the path is a glob
+// pattern, and that it is not combined with options of a single secret.
+func (s *Spec) validateWildcard() error {
+	if strings.ContainsAny(path.Dir(s.Path), wildcardChars) {
+		return errors.New("only the last segment of a path may be a wildcard")
+	}
+
+	if !s.IsWildcard() {
+		return nil
+	}
+
+	if _, err := path.Match(path.Base(s.Path), ""); err != nil {
+		return errors.Wrap(err, "could not parse wildcard")
+	}
+
+	if s.Pinned() || s.Method != "" || len(s.Params) > 0 {
+		return errors.New("wildcards can not be combined with a version, method or parameters")
+	}
+
+	return nil
+}
+
+// isNumeric returns true if value is a non-empty string of digits.
+func isNumeric(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,136 @@
+package secret
+
+import "testing"
+
+func TestParseSpec(t *testing.T) {
+	cases := []struct {
+		raw         string
+		namespace   string
+		path        string
+		version     int
+		requestPath string
+	}{
+		{"/secret/data/shared", "", "/secret/data/shared", 0, "/secret/data/shared"},
+		{"team-a::secret/data/shared", "team-a", "secret/data/shared", 0, "team-a/secret/data/shared"},
+		{"/org/team-a/::/secret/data/shared", "org/team-a", "/secret/data/shared", 0, "org/team-a/secret/data/shared"},
+		{"secret/shared@3", "", "secret/shared", 3, "secret/shared"},
+		{"team-a::secret/shared@12", "team-a", "secret/shared", 12, "team-a/secret/shared"},
+		{"secret/users/jane@example.com", "", "secret/users/jane@example.com", 0, "secret/users/jane@example.com"},
+		{"POST:team-a::pki/issue/web?common_name={{.Hostname}}", "team-a", "pki/issue/web", 0, "team-a/pki/issue/web"},
+	}
+
+	for _, c := range cases {
+		spec, err := ParseSpec(c.raw)
+		if err != nil {
+			t.Errorf("unexpected error parsing `%s`: %v", c.raw, err)
+			continue
+		}
+
+		if spec.Namespace != c.namespace || spec.Path != c.path || spec.Version != c.version {
+			t.Errorf("expected `%s` to parse to namespace '%s', path '%s' and version %d, got: %#v", c.raw, c.namespace, c.path, c.version, spec)
+		}
+
+		if spec.RequestPath() != c.requestPath {
+			t.Errorf("expected request path for `%s` to be '%s', got: %s", c.raw, c.requestPath, spec.RequestPath())
+		}
+	}
+
+	for _, raw := range []string{"::secret/data/shared", "team-a::", "/", "secret/shared@0", "@3", "POST:secret/shared@3", "secret/shared@3?version=2", "pki/issue/web?ttl=%zz", "secret/*/shared", "secret/services/[a", "POST:pki/issue/*"} {
+		if _, err := ParseSpec(raw); err == nil {
+			t.Errorf("expected error parsing `%s`", raw)
+		}
+	}
+}
+
+func TestParseSpecRequest(t *testing.T) {
+	spec, err := ParseSpec("POST:pki/issue/web?common_name={{.Hostname}}&alt_names=a.example.com&alt_names=b.example.com")
+	if err != nil {
+		t.Fatalf("unexpected error parsing request spec: %v", err)
+	}
+
+	if spec.Method != "POST" || !spec.IsWrite() || spec.Path != "pki/issue/web" {
+		t.Errorf("expected POST request to 'pki/issue/web', got: %#v", spec)
+	}
+
+	if spec.Params.Get("common_name") != "{{.Hostname}}" || len(spec.Params["alt_names"]) != 2 {
+		t.Errorf("expected request parameters to be parsed, got: %v", spec.Params)
+	}
+
+	// Only known methods are taken as a method prefix
+	spec, err = ParseSpec("DELETE:secret/shared")
+	if err != nil {
+		t.Fatalf("unexpected error parsing spec: %v", err)
+	}
+
+	if spec.Method != "" || spec.IsWrite() || spec.Path != "DELETE:secret/shared" {
+		t.Errorf("expected unknown method prefix to be kept in the path, got: %#v", spec)
+	}
+}
+
+func TestParseSpecWildcard(t *testing.T) {
+	spec, err := ParseSpec("team-a::secret/services/web-*")
+	if err != nil {
+		t.Fatalf("unexpected error parsing wildcard spec: %v", err)
+	}
+
+	if !spec.IsWildcard() {
+		t.Errorf("expected `%s` to be a wildcard", spec.Raw)
+	}
+
+	if expanded := spec.Expand("secret/services", "web-api"); expanded.Raw != "?team-a::secret/services/web-api" || expanded.Namespace != "team-a" || !expanded.Optional {
+		t.Errorf("expected expanded path to keep the namespace, got: %#v", expanded)
+	}
+
+	// Matched keys are never parsed, so spec syntax in them is kept in the path
+	for _, key := range []string{"db@2", "web?ttl=1h", "POST:db"} {
+		expanded := spec.Expand("secret/services", key)
+		if expanded.Path != "secret/services/"+key || expanded.Version != 0 || expanded.Method != "" || len(expanded.Params) != 0 {
+			t.Errorf("expected key `%s` to be kept in the path, got: %#v", key, expanded)
+		}
+	}
+}
+
+func TestParseSpecAlias(t *testing.T) {
+	spec, err := ParseSpec("db=POST:team-a::database/creds/app?ttl=1h")
+	if err != nil {
+		t.Fatalf("unexpected error parsing aliased spec: %v", err)
+	}
+
+	if spec.Alias != "db" || spec.Method != "POST" || spec.Namespace != "team-a" || spec.Path != "database/creds/app" {
+		t.Errorf("expected alias 'db' for POST to 'team-a::database/creds/app', got: %#v", spec)
+	}
+
+	spec, err = ParseSpec("services=secret/services/*")
+	if err != nil {
+		t.Fatalf("unexpected error parsing aliased wildcard: %v", err)
+	}
+
+	if expanded := spec.Expand("secret/services", "web-api"); expanded.Alias != "services.web_api" || expanded.Path != "secret/services/web-api" {
+		t.Errorf("expected expanded key to be nested under the alias, got: %#v", expanded)
+	}
+
+	// Only identifiers are aliases, so `=` may still appear in paths
+	spec, err = ParseSpec("secret/a=b")
+	if err != nil {
+		t.Fatalf("unexpected error parsing spec: %v", err)
+	}
+
+	if spec.Alias != "" || spec.Path != "secret/a=b" {
+		t.Errorf("expected path with `=` not to be aliased, got: %#v", spec)
+	}
+}
+
+func TestParseSpecOptional(t *testing.T) {
+	spec, err := ParseSpec("?db=secret/shared?version=2")
+	if err != nil {
+		t.Fatalf("unexpected error parsing optional spec: %v", err)
+	}
+
+	if !spec.Optional || spec.Alias != "db" || spec.Path != "secret/shared" || spec.Params.Get("version") != "2" {
+		t.Errorf("expected optional spec aliased 'db' for 'secret/shared' with parameters, got: %#v", spec)
+	}
+
+	if spec, _ := ParseSpec("secret/shared"); spec.Optional {
+		t.Errorf("expected paths to be required unless marked optional")
+	}
+}
@@ -108,6 +108,16 @@ func (s *Supervisor) handleChildStateUpdate(supState *state, childState *os.Proc
 		"userTime":   childState.UserTime(),
 	}).Debugf("Child process died; restarting")
 
+	if s.config.RequestEnvironment != nil {
+		log.Debugf("Requesting a fresh environment to restart the child with")
+		if err := s.config.RequestEnvironment(); err != nil {
+			log.WithError(err).Errorf("Could not request environment")
+			return true, errors.Wrapf(err, "error requesting environment")
+		}
+
+		return false, nil
+	}
+
 	if err := s.restartChild(supState, s.lastEnv); err != nil {
 		log.WithError(err).Errorf("Could not restart child")
 		return true, errors.Wrapf(err, "error restarting child")
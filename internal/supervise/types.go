@@ -41,6 +41,11 @@ type Config struct {
 
 	// OneShot tells the supervisor not to restart the child after it exits
 	OneShot bool
+
+	// RequestEnvironment, if set, is called when the child exits instead of
+	// restarting it with the last environment. The child is then restarted
+	// once the requested environment update arrives.
+	RequestEnvironment func() error
 }
 
 // Supervisor is the actual supervisor instance, providing methods
@@ -9,7 +9,7 @@ import (
 
 // NewEnvTemplate creates an EnvTemplate instance
 func NewEnvTemplate(envKey, envValue string) (*EnvTemplate, error) {
-	tpl, err := template.New(envKey).Parse(envValue)
+	tpl, err := template.New(envKey).Funcs(makeFuncMap()).Parse(envValue)
 	if err != nil {
 		log.WithError(err).Errorf("Error while parsing template for environment var: %s", envKey)
 		return nil, errors.Wrapf(err, "could not parse template")
@@ -20,11 +20,17 @@ func NewEnvTemplate(envKey, envValue string) (*EnvTemplate, error) {
 		value:    envValue,
 		template: tpl,
 	}
-	envTpl.template = envTpl.template.Funcs(makeFuncMap())
 
 	return envTpl, nil
 }
 
+// setTransitCache makes the `decrypt` template function use the given cache.
+func (e *EnvTemplate) setTransitCache(cache *transitCache) {
+	e.template.Funcs(template.FuncMap{
+		"decrypt": cache.decrypt,
+	})
+}
+
 // Render returns a string with the rendered template
 func (e *EnvTemplate) Render(context map[string]interface{}) (string, error) {
 	rendered := bytes.NewBufferString("")
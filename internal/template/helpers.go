@@ -12,7 +12,8 @@ import (
 
 func makeFuncMap() template.FuncMap {
 	return template.FuncMap{
-		"json": encodeAsJSON,
+		"decrypt": decryptUnavailable,
+		"json":    encodeAsJSON,
 	}
 }
 
@@ -21,12 +22,76 @@ func encodeAsJSON(value interface{}) ([]byte, error) {
 }
 
 // RenderEnvironmentWithDataMap renders an environment variable mapping from
-// the data map derived from secrets.
-func RenderEnvironmentFromDataMap(cfg *vaultclient.Config, dataMap map[string]interface{}) (map[string]string, error) {
-	environ := os.Environ()
-	envMap := make(map[string]string, 0)
+// the data map derived from secrets. Values passed to the `decrypt` template
+// function are decrypted through the client's transit engine.
+func RenderEnvironmentFromDataMap(client vaultclient.VaultClient, dataMap map[string]interface{}) (map[string]string, error) {
+	envMap, _, err := RenderEnvironmentWithPlaintexts(client, dataMap)
+	return envMap, err
+}
+
+// RenderEnvironmentWithPlaintexts renders the environment like
+// RenderEnvironmentFromDataMap, and returns the values that were decrypted
+// along with it, so that they can be cached.
+func RenderEnvironmentWithPlaintexts(client vaultclient.VaultClient, dataMap map[string]interface{}) (map[string]string, Plaintexts, error) {
+	cache := newTransitCache(client)
+	templates, err := parseEnvironment(client.GetConfig(), cache)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The first render collects the values to decrypt, so that they can be
+	// decrypted in batches before rendering again
+	envMap, err := renderTemplates(templates, dataMap)
+	if cache.hasPending() {
+		if err := cache.resolve(); err != nil {
+			return nil, nil, errors.Wrap(err, "could not decrypt environment variable values")
+		}
+
+		envMap, err = renderTemplates(templates, dataMap)
+	}
 
-	for _, envVar := range environ {
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not render environment variable template")
+	}
+
+	return envMap, cache.plaintexts, nil
+}
+
+// RenderEnvironmentFromCache renders the environment from a cached data map
+// without contacting Vault. Values passed to the `decrypt` template function
+// are looked up in the cached plaintexts; environment variables that decrypt
+// a value which is not cached are left out.
+func RenderEnvironmentFromCache(client vaultclient.VaultClient, dataMap map[string]interface{}, plaintexts Plaintexts) (map[string]string, error) {
+	cache := newCachedTransitCache(plaintexts)
+	templates, err := parseEnvironment(client.GetConfig(), cache)
+	if err != nil {
+		return nil, err
+	}
+
+	envMap := make(map[string]string, len(templates))
+	for key, tpl := range templates {
+		cache.missed = false
+
+		rendered, err := tpl.Render(dataMap)
+		if cache.missed {
+			log.WithField("envVar", key).Warnf("Leaving out environment variable, as a value it decrypts is not cached")
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "could not render template for environment variable `%s`", key)
+		}
+
+		envMap[key] = rendered
+	}
+
+	return envMap, nil
+}
+
+// parseEnvironment parses the templates of all environment variables that
+// are passed on to the child, with `decrypt` answered by the given cache.
+func parseEnvironment(cfg *vaultclient.Config, cache *transitCache) (map[string]*EnvTemplate, error) {
+	templates := make(map[string]*EnvTemplate, 0)
+
+	for _, envVar := range os.Environ() {
 		pair := strings.SplitN(envVar, "=", 2)
 
 		key, value := pair[0], pair[1]
@@ -39,10 +104,23 @@ func RenderEnvironmentFromDataMap(cfg *vaultclient.Config, dataMap map[string]in
 			return nil, errors.Wrap(err, "could not parse environment variable template")
 		}
 
-		envMap[key], err = tpl.Render(dataMap)
+		tpl.setTransitCache(cache)
+		templates[key] = tpl
+	}
+
+	return templates, nil
+}
+
+func renderTemplates(templates map[string]*EnvTemplate, dataMap map[string]interface{}) (map[string]string, error) {
+	envMap := make(map[string]string, len(templates))
+
+	for key, tpl := range templates {
+		rendered, err := tpl.Render(dataMap)
 		if err != nil {
-			return nil, errors.Wrap(err, "could not render environment variable template")
+			return nil, errors.Wrapf(err, "could not render template for environment variable `%s`", key)
 		}
+
+		envMap[key] = rendered
 	}
 
 	return envMap, nil
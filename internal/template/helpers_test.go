@@ -0,0 +1,63 @@
+package template
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient/dummy"
+)
+
+func TestRenderEnvironmentDecrypt(t *testing.T) {
+	// Plaintexts are the key and the ciphertext without its prefix
+	client := dummy.NewFake(vaultclient.NewConfigWithDefaults())
+	client.Decrypt = func(key, ciphertext string) string {
+		return key + ":" + strings.TrimPrefix(ciphertext, "vault:v1:")
+	}
+
+	os.Setenv("TEST_DECRYPT_A", `{{ decrypt "app" "vault:v1:first" }}`)
+	os.Setenv("TEST_DECRYPT_B", `{{ "vault:v1:second" | decrypt "app" }}-{{ decrypt "app" "vault:v1:first" }}`)
+	defer os.Unsetenv("TEST_DECRYPT_A")
+	defer os.Unsetenv("TEST_DECRYPT_B")
+
+	environ, err := RenderEnvironmentFromDataMap(client, map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("unexpected error rendering environment: %v", err)
+	}
+
+	if environ["TEST_DECRYPT_A"] != "app:first" || environ["TEST_DECRYPT_B"] != "app:second-app:first" {
+		t.Errorf("expected ciphertexts to be replaced by plaintexts, got: %s, %s", environ["TEST_DECRYPT_A"], environ["TEST_DECRYPT_B"])
+	}
+
+	if batches := client.Batches(); len(batches) != 1 || len(batches[0]) != 2 {
+		t.Errorf("expected a single batch with each ciphertext once, got: %v", batches)
+	}
+}
+
+func TestRenderEnvironmentFromCache(t *testing.T) {
+	client := dummy.NewFake(vaultclient.NewConfigWithDefaults())
+
+	os.Setenv("TEST_DECRYPT_A", `{{ decrypt "app" "vault:v1:first" }}`)
+	os.Setenv("TEST_DECRYPT_B", `{{ decrypt "app" "vault:v1:second" }}`)
+	defer os.Unsetenv("TEST_DECRYPT_A")
+	defer os.Unsetenv("TEST_DECRYPT_B")
+
+	plaintexts := Plaintexts{"app": {"vault:v1:first": "app:first"}}
+	environ, err := RenderEnvironmentFromCache(client, map[string]interface{}{}, plaintexts)
+	if err != nil {
+		t.Fatalf("unexpected error rendering environment: %v", err)
+	}
+
+	if environ["TEST_DECRYPT_A"] != "app:first" {
+		t.Errorf("expected cached plaintext to be used, got: %s", environ["TEST_DECRYPT_A"])
+	}
+
+	if _, ok := environ["TEST_DECRYPT_B"]; ok {
+		t.Errorf("expected variable decrypting a value that is not cached to be left out, got: %s", environ["TEST_DECRYPT_B"])
+	}
+
+	if batches := client.Batches(); len(batches) != 0 {
+		t.Errorf("expected nothing to be decrypted through Vault, got: %v", batches)
+	}
+}
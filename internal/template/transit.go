@@ -0,0 +1,100 @@
+package template
+
+import (
+	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+)
+
+// transitCache collects the ciphertexts templates ask to decrypt and holds
+// their plaintexts for the duration of a single render, so that every transit
+// key is only asked once per render, with all of its ciphertexts in a batch.
+type transitCache struct {
+	client vaultclient.VaultClient
+
+	// plaintexts maps transit key and ciphertext to the plaintext
+	plaintexts Plaintexts
+	// pending holds the ciphertexts of each transit key that still need to be decrypted
+	pending map[string][]string
+
+	// offline is set for caches that only answer from known plaintexts,
+	// which fail ciphertexts they do not know instead of collecting them
+	offline bool
+	// missed is set once an offline cache was asked for an unknown ciphertext
+	missed bool
+}
+
+func newTransitCache(client vaultclient.VaultClient) *transitCache {
+	return &transitCache{
+		client:     client,
+		plaintexts: make(Plaintexts, 0),
+		pending:    make(map[string][]string, 0),
+	}
+}
+
+// newCachedTransitCache creates an offline cache answering from the given
+// plaintexts, without contacting Vault.
+func newCachedTransitCache(plaintexts Plaintexts) *transitCache {
+	return &transitCache{
+		plaintexts: plaintexts,
+		pending:    make(map[string][]string, 0),
+		offline:    true,
+	}
+}
+
+// decrypt is the `decrypt` template function. Returns the plaintext if it is
+// known already; otherwise records the ciphertext and returns an empty string
+// until the pending ciphertexts are resolved.
+func (c *transitCache) decrypt(key, ciphertext string) (string, error) {
+	if plaintext, ok := c.plaintexts[key][ciphertext]; ok {
+		return plaintext, nil
+	}
+
+	if c.offline {
+		c.missed = true
+		return "", errors.Errorf("value encrypted with transit key `%s` is not cached", key)
+	}
+
+	for _, pending := range c.pending[key] {
+		if pending == ciphertext {
+			return "", nil
+		}
+	}
+
+	c.pending[key] = append(c.pending[key], ciphertext)
+
+	return "", nil
+}
+
+// hasPending returns true if any ciphertext still needs to be decrypted.
+func (c *transitCache) hasPending() bool {
+	return len(c.pending) > 0
+}
+
+// resolve decrypts all pending ciphertexts, one batch per transit key.
+func (c *transitCache) resolve() error {
+	for key, ciphertexts := range c.pending {
+		plaintexts, err := c.client.TransitDecrypt(key, ciphertexts)
+		if err != nil {
+			return errors.Wrapf(err, "could not decrypt values with transit key `%s`", key)
+		}
+
+		if c.plaintexts[key] == nil {
+			c.plaintexts[key] = make(map[string]string, len(ciphertexts))
+		}
+
+		for idx, ciphertext := range ciphertexts {
+			c.plaintexts[key][ciphertext] = plaintexts[idx]
+		}
+
+		delete(c.pending, key)
+	}
+
+	return nil
+}
+
+// decryptUnavailable stands in for the `decrypt` template function outside of
+// an environment render.
+func decryptUnavailable(key, ciphertext string) (string, error) {
+	return "", errors.New("decrypt is only available while rendering the environment")
+}
@@ -10,3 +10,7 @@ type EnvTemplate struct {
 	value    string
 	template *template.Template
 }
+
+// Plaintexts maps transit key and ciphertext to the plaintext of the values
+// passed to the `decrypt` template function.
+type Plaintexts map[string]map[string]string
@@ -2,6 +2,8 @@ package vaultclient
 
 import (
 	vaultApi "github.com/hashicorp/vault/api"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
 )
 
 // NewConfigWithDefaults creates a vaultclient.Config with the
@@ -9,7 +11,9 @@ import (
 func NewConfigWithDefaults() *Config {
 	defaults := vaultApi.DefaultConfig()
 	return &Config{
-		Config: defaults,
+		Config:          defaults,
+		CollisionPolicy: secret.CollisionFirstWins,
+		ContextNesting:  secret.NestingFullPath,
 	}
 }
 
@@ -0,0 +1,136 @@
+package dummy
+
+import (
+	"sync"
+
+	vaultApi "github.com/hashicorp/vault/api"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+)
+
+var _ vaultclient.VaultClient = (*Fake)(nil)
+
+// Fake is a dummy client that hands out the secrets returned by Issue and
+// records the fetches, revocations and decryptions it was asked for. It is
+// meant for testing code that uses a VaultClient.
+type Fake struct {
+	*Client
+
+	// Issue returns the secret fetched for a spec on every fetch. If it is
+	// unset or returns nil, there is no secret at the path.
+	Issue func(spec *secret.Spec) *vaultApi.Secret
+
+	// Decrypt returns the plaintext of a ciphertext decrypted with the given
+	// transit key.
+	Decrypt func(key, ciphertext string) string
+
+	// lock guards all of the fields below
+	lock    sync.Mutex
+	fetched []string
+	revoked []string
+	batches [][]string
+}
+
+// NewFake creates a new instance of the fake VaultClient implementation.
+func NewFake(config *vaultclient.Config) *Fake {
+	return &Fake{Client: &Client{config: config}}
+}
+
+// FetchSecret fetches a secret from Vault, wrapping it into a *secret.Secret.
+func (f *Fake) FetchSecret(path string) (*secret.Secret, error) {
+	spec, err := secret.ParseSpec(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.FetchSpec(spec)
+}
+
+// FetchSpec fetches the secret described by a parsed path from Vault, wrapping it into a *secret.Secret.
+func (f *Fake) FetchSpec(spec *secret.Spec) (*secret.Secret, error) {
+	f.lock.Lock()
+	f.fetched = append(f.fetched, spec.Raw)
+	f.lock.Unlock()
+
+	if f.Issue == nil {
+		return nil, nil
+	}
+
+	issued := f.Issue(spec)
+	if issued == nil {
+		return nil, nil
+	}
+
+	return secret.NewFromSpec(spec, issued), nil
+}
+
+// FetchSecrets fetches all of the secrets defined in the configuration, expanding wildcard paths.
+func (f *Fake) FetchSecrets() ([]*secret.Secret, error) {
+	specs, err := f.ExpandPaths()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make([]*secret.Secret, 0, len(specs))
+	for _, spec := range specs {
+		sec, err := f.FetchSpec(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if sec != nil {
+			secrets = append(secrets, sec)
+		}
+	}
+
+	return secrets, nil
+}
+
+// RevokeLease takes a lease ID and revokes it.
+func (f *Fake) RevokeLease(leaseID string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.revoked = append(f.revoked, leaseID)
+	return nil
+}
+
+// TransitDecrypt decrypts a batch of ciphertexts with the given transit key and returns the
+// plaintexts in the same order.
+func (f *Fake) TransitDecrypt(key string, ciphertexts []string) ([]string, error) {
+	f.lock.Lock()
+	f.batches = append(f.batches, ciphertexts)
+	f.lock.Unlock()
+
+	plaintexts := make([]string, len(ciphertexts))
+	for idx, ciphertext := range ciphertexts {
+		plaintexts[idx] = f.Decrypt(key, ciphertext)
+	}
+
+	return plaintexts, nil
+}
+
+// Fetched returns the raw spec of every fetch, in order.
+func (f *Fake) Fetched() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string{}, f.fetched...)
+}
+
+// Revoked returns the IDs of the revoked leases, in order.
+func (f *Fake) Revoked() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]string{}, f.revoked...)
+}
+
+// Batches returns the ciphertexts of every transit decryption, in order.
+func (f *Fake) Batches() [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([][]string{}, f.batches...)
+}
@@ -22,11 +22,38 @@ func (vc *Client) CreateChildToken(string) (*vaultApi.Secret, error) {
 	return &vaultApi.Secret{}, nil
 }
 
+// CreateHandoffToken creates a non-renewable token limited to TokenNumUses, which is handed to the
+// application instead of the child token, so that vault-init's own requests do not use it up.
+func (vc *Client) CreateHandoffToken(string) (*vaultApi.Secret, error) {
+	return &vaultApi.Secret{}, nil
+}
+
+// ExpandPaths returns the parsed configured paths, with wildcard paths replaced by the specs of
+// the secrets they match.
+func (vc *Client) ExpandPaths() ([]*secret.Spec, error) {
+	specs := make([]*secret.Spec, 0, len(vc.config.Paths))
+	for _, raw := range vc.config.Paths {
+		spec, err := secret.ParseSpec(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
 // FetchSecret fetches a secret from Vault, wrapping it into a *secret.Secret.
 func (vc *Client) FetchSecret(string) (*secret.Secret, error) {
 	return nil, nil
 }
 
+// FetchSpec fetches the secret described by a parsed path from Vault, wrapping it into a *secret.Secret.
+func (vc *Client) FetchSpec(*secret.Spec) (*secret.Secret, error) {
+	return nil, nil
+}
+
 // FetchSecrets fetches all of the secrets defined in the configuration.
 func (vc *Client) FetchSecrets() ([]*secret.Secret, error) {
 	return nil, nil
@@ -37,18 +64,65 @@ func (vc *Client) GetConfig() *vaultclient.Config {
 	return vc.config
 }
 
+// HandOverChildToken hands the given token over to the child: it is response-wrapped if
+// ChildTokenWrapTTL is set, and written to ChildTokenFile if set. InjectChildContext exposes
+// the wrapping token until the next hand-over.
+func (vc *Client) HandOverChildToken(string) error {
+	return nil
+}
+
 // InjectChildContext inserts context into the pre-environment data-map
 // to provide Vault context, etc, to the child process.
 func (vc *Client) InjectChildContext(target map[string]interface{}) (map[string]interface{}, error) {
 	return target, nil
 }
 
+// Login authenticates against the auth method mounted at the given path with the given
+// login data and returns the resulting auth secret. The client's token is left unchanged.
+func (vc *Client) Login(mount string, data map[string]interface{}) (*vaultApi.Secret, error) {
+	return &vaultApi.Secret{
+		Auth: &vaultApi.SecretAuth{
+			ClientToken: "dummy-token-" + mount,
+		},
+	}, nil
+}
+
+// LookupSelf looks up the token the client is currently using. Returns nil if Vault reports
+// the token as invalid, such as when it was revoked or has expired.
+func (vc *Client) LookupSelf() (*vaultApi.Secret, error) {
+	return &vaultApi.Secret{}, nil
+}
+
+// LookupToken looks up the given token with its own permissions, as lookup-self does. Returns nil
+// if Vault reports the token as invalid, such as when it was revoked or has expired.
+func (vc *Client) LookupToken(string) (*vaultApi.Secret, error) {
+	return &vaultApi.Secret{}, nil
+}
+
+// LookupWrappingToken looks up the given response-wrapping token without consuming it. Returns
+// nil if the token is not a valid wrapping token, which includes wrapping tokens that were already used.
+func (vc *Client) LookupWrappingToken(string) (*vaultApi.Secret, error) {
+	return nil, nil
+}
+
 // NewLeaseRenewer creates a goroutine that constantly renews the secret lease that is configured
 // in the *vaultApi.RenewerInput.
 func (vc *Client) NewLeaseRenewer(*vaultApi.RenewerInput) (*vaultApi.Renewer, error) {
 	return nil, nil
 }
 
+// RequestUpdate asks the running watcher to render and send the environment again, even
+// if none of the secrets changed.
+func (vc *Client) RequestUpdate() error {
+	return nil
+}
+
+// RequestRefetch asks the running watcher to fetch every leased secret again with the token
+// the client is using, and then to send the environment again.
+func (vc *Client) RequestRefetch() error {
+	return nil
+}
+
 // RevokeSecret revokes a leased secret.
 func (vc *Client) RevokeSecret(*secret.Secret) error {
 	return nil
@@ -64,11 +138,21 @@ func (vc *Client) RevokeLease(string) error {
 	return nil
 }
 
+// RevokeLeases revokes every lease obtained through FetchSecret that was not revoked yet.
+func (vc *Client) RevokeLeases() error {
+	return nil
+}
+
 // ReadLogical reads the secret at a given logical path inside of Vault.
 func (vc *Client) ReadLogical(string) (*vaultApi.Secret, error) {
 	return nil, nil
 }
 
+// SetHandoffToken sets the token handed to the application instead of the token the client is
+// using. An empty token hands the client's token over.
+func (vc *Client) SetHandoffToken(string) {
+}
+
 // SetToken sets the token that should be used to authenticate to Vault.
 func (vc *Client) SetToken(string) error {
 	return nil
@@ -81,8 +165,10 @@ func (vc *Client) StartWatcher(context.Context, time.Duration) (chan []string, e
 	return out, nil
 }
 
-// StartSecretRenewer starts a renewer for the given secret.
-func (vc *Client) StartSecretRenewer(*secret.Secret) error {
+// StartSecretRenewer starts a renewer for the given secret. Renewals are sent to the first channel,
+// and the secret is sent to the second once its lease can no longer be renewed. Sends are given up
+// once the done channel is closed.
+func (vc *Client) StartSecretRenewer(*secret.Secret, <-chan struct{}, chan<- *secret.Renewal, chan<- *secret.Secret) error {
 	return nil
 }
 
@@ -90,3 +176,14 @@ func (vc *Client) StartSecretRenewer(*secret.Secret) error {
 func (vc *Client) StopSecretRenewer(*secret.Secret) error {
 	return nil
 }
+
+// TransitDecrypt decrypts a batch of ciphertexts with the given transit key and returns the
+// plaintexts in the same order.
+func (vc *Client) TransitDecrypt(key string, ciphertexts []string) ([]string, error) {
+	return ciphertexts, nil
+}
+
+// Unwrap consumes the given response-wrapping token and returns the wrapped response.
+func (vc *Client) Unwrap(string) (*vaultApi.Secret, error) {
+	return &vaultApi.Secret{}, nil
+}
@@ -18,9 +18,15 @@ func NewClient(config *vaultclient.Config) (vaultclient.VaultClient, error) {
 		return nil, errors.Wrap(err, "could not create Vault API client")
 	}
 
+	if config.Namespace != "" {
+		vaultClient.SetNamespace(config.Namespace)
+	}
+
 	return &Client{
 		vaultClient: vaultClient,
 		config:      config,
+		leases:      make(map[string]string, 0),
+		kvMounts:    make(map[string]*kvMount, 0),
 	}, nil
 }
 
@@ -55,9 +61,10 @@ func (vc *Client) vaultSettingsAsMap() map[string]interface{} {
 	data["address"] = vc.config.Address
 	data["agent_address"] = vc.config.AgentAddress
 	data["max_retries"] = vc.config.MaxRetries
+	data["namespace"] = vc.config.Namespace
 	data["timeout"] = vc.config.Timeout.String()
 	data["tls"] = tlsConfig
-	data["token"] = vc.vaultClient.Token()
+	data["token"] = vc.childToken()
 
 	return data
 }
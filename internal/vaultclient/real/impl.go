@@ -2,8 +2,14 @@ package real
 
 import (
 	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	vaultApi "github.com/hashicorp/vault/api"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -42,24 +48,59 @@ func (vc *Client) Check() error {
 // CreateChildToken creates a token that can be used by the spawned
 // child
 func (vc *Client) CreateChildToken(displayName string) (*vaultApi.Secret, error) {
-	tokenAuth := vc.vaultClient.Auth().Token()
+	// Batch tokens can never be renewed
+	renewable := !vc.config.DisableTokenRenew && vc.config.TokenType != "batch"
+
+	return vc.createToken(displayName, 0, renewable)
+}
+
+// CreateHandoffToken creates the token that is handed to the child when
+// TokenNumUses limits its uses, so that vault-init's own requests with the
+// child token do not count towards the limit. Renewing a token uses it up as
+// well, so it is not renewable and is replaced shortly before it expires.
+func (vc *Client) CreateHandoffToken(displayName string) (*vaultApi.Secret, error) {
+	return vc.createToken(displayName, vc.config.TokenNumUses, false)
+}
+
+// SetHandoffToken sets the token that is handed to the child instead of the
+// token the client is using. An empty token hands the client's token over.
+func (vc *Client) SetHandoffToken(token string) {
+	vc.handoffLock.Lock()
+	defer vc.handoffLock.Unlock()
+
+	vc.handoffToken = token
+}
+
+// createToken creates a token with the configured settings from the token the
+// client is connecting with.
+func (vc *Client) createToken(displayName string, numUses int, renewable bool) (*vaultApi.Secret, error) {
 	var creatorFn vaultclient.TokenCreatorFunc
 	var noTokenParent bool
 
-	if vc.config.OrphanToken {
-		creatorFn = tokenAuth.CreateOrphan
+	if vc.config.TokenRole != "" {
+		creatorFn = vc.tokenCreator("/v1/auth/token/create/" + url.PathEscape(vc.config.TokenRole))
+		noTokenParent = false
+	} else if vc.config.OrphanToken {
+		creatorFn = vc.tokenCreator("/v1/auth/token/create-orphan")
 		noTokenParent = true
 	} else {
-		creatorFn = tokenAuth.Create
+		creatorFn = vc.tokenCreator("/v1/auth/token/create")
 		noTokenParent = false
 	}
 
-	renewable := !vc.config.DisableTokenRenew
-
-	createReq := &vaultApi.TokenCreateRequest{
-		NoParent:  noTokenParent,
-		Policies:  vc.config.AccessPolicies,
-		Renewable: &renewable,
+	createReq := &vaultclient.TokenCreateRequest{
+		TokenCreateRequest: vaultApi.TokenCreateRequest{
+			DisplayName:    displayName,
+			EntityAlias:    vc.config.TokenEntityAlias,
+			ExplicitMaxTTL: vc.config.TokenExplicitMaxTTL,
+			Metadata:       vc.config.TokenMetadata,
+			NoParent:       noTokenParent,
+			NumUses:        numUses,
+			Policies:       vc.config.AccessPolicies,
+			Renewable:      &renewable,
+			Type:           vc.config.TokenType,
+		},
+		BoundCIDRs: vc.config.TokenBoundCIDRs,
 	}
 
 	if vc.config.TokenTTL != "" && vc.config.TokenPeriod != "" {
@@ -82,6 +123,33 @@ func (vc *Client) CreateChildToken(displayName string) (*vaultApi.Secret, error)
 	return sec, nil
 }
 
+// tokenCreator returns a TokenCreatorFunc that posts the token creation
+// request to the given token creation endpoint, which may hold escaped
+// path segments.
+func (vc *Client) tokenCreator(createPath string) vaultclient.TokenCreatorFunc {
+	return func(createReq *vaultclient.TokenCreateRequest) (*vaultApi.Secret, error) {
+		req := vc.vaultClient.NewRequest("POST", createPath)
+
+		// The role name in the path is escaped already, so it must be sent
+		// as it is instead of being escaped again
+		if unescaped, err := url.PathUnescape(req.URL.Path); err == nil {
+			req.URL.RawPath = req.URL.Path
+			req.URL.Path = unescaped
+		}
+		if err := req.SetJSONBody(createReq); err != nil {
+			return nil, errors.Wrap(err, "could not encode token creation request")
+		}
+
+		resp, err := vc.vaultClient.RawRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		return vaultApi.ParseSecret(resp.Body)
+	}
+}
+
 func (vc *Client) GetConfig() *vaultclient.Config {
 	return vc.config
 }
@@ -99,27 +167,88 @@ func (vc *Client) SetToken(v string) error {
 }
 
 // FetchSecret fetches an individual secret path from Vault, wrapping it into a *secret.Secret.
+// The path may be prefixed with a namespace, as in `namespace::path`. Returns nil if there
+// is no secret at the path.
 func (vc *Client) FetchSecret(path string) (*secret.Secret, error) {
-	sec, err := vc.ReadLogical(path)
+	spec, err := secret.ParseSpec(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse secret path: %s", path)
+	}
+
+	return vc.FetchSpec(spec)
+}
+
+// FetchSpec fetches the secret described by a parsed `--path` entry. Returns nil if
+// there is no secret at the path, or an empty placeholder if the spec is optional.
+func (vc *Client) FetchSpec(spec *secret.Spec) (*secret.Secret, error) {
+	path := spec.Raw
+
+	requestPath, logicalPath, kvv2, err := vc.resolveKVPath(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not resolve secret path: %s", path)
+	}
+
+	params, err := renderRequestParams(spec)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not render request parameters for path: %s", path)
+	}
+
+	var sec *vaultApi.Secret
+	switch {
+	case spec.IsWrite():
+		sec, err = vc.writeRequest(spec.Method, requestPath, params)
+	case spec.Pinned():
+		sec, err = vc.readKVVersion(requestPath, spec.Version)
+	case len(params) > 0:
+		sec, err = vc.vaultClient.Logical().ReadWithData(requestPath, params)
+	default:
+		sec, err = vc.ReadLogical(requestPath)
+	}
+
 	if err != nil {
 		return nil, errors.Wrapf(err, "could not get secret at path: %s", path)
 	}
 
-	return secret.New(path, sec), nil
+	if sec == nil {
+		if spec.Optional {
+			log.WithField("secretPath", path).Infof("Optional secret does not exist; using an empty entry")
+			return secret.NewMissing(spec), nil
+		}
+
+		return nil, nil
+	}
+
+	if sec.LeaseID != "" {
+		vc.leasesLock.Lock()
+		vc.leases[sec.LeaseID] = path
+		vc.leasesLock.Unlock()
+	}
+
+	fetched := secret.NewFromSpec(spec, sec)
+	if kvv2 {
+		fetched.Path = logicalPath
+		fetched.KVv2 = true
+	}
+
+	return fetched, nil
 }
 
 // FetchSecrets fetches all the secret paths listed in the configuration.
 func (vc *Client) FetchSecrets() ([]*secret.Secret, error) {
+	specs, err := vc.ExpandPaths()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not expand secret paths")
+	}
+
 	secrets := make([]*secret.Secret, 0)
-	for _, path := range vc.config.Paths {
-		sec, err := vc.FetchSecret(path)
+	for _, spec := range specs {
+		sec, err := vc.FetchSpec(spec)
 		if err != nil {
-			return nil, errors.Wrapf(err, "could not get secret at path: %s", path)
+			return nil, errors.Wrapf(err, "could not get secret at path: %s", spec.Raw)
 		}
 
 		if sec == nil {
-			log.Warnf("secret at %s is nil, skipping", path)
-			continue
+			return nil, errors.Errorf("required secret at path `%s` does not exist; mark it optional as `?%s` to allow this", spec.Raw, spec.Raw)
 		}
 
 		secrets = append(secrets, sec)
@@ -133,12 +262,173 @@ func (vc *Client) InjectChildContext(dataMap map[string]interface{}) (map[string
 	// If token inheritance is enabled, include the Vault connection
 	// information in the environment context
 	if !vc.config.NoInheritToken {
-		dataMap["Vault"] = vc.vaultSettingsAsMap()
+		settings := vc.vaultSettingsAsMap()
+
+		if vc.config.ChildTokenWrapTTL != "" {
+			wrapInfo := vc.wrappedChildToken()
+			if wrapInfo == nil {
+				return nil, errors.New("child token has not been handed over yet")
+			}
+
+			// Never expose the raw token when the child should unwrap it
+			delete(settings, "token")
+			settings["wrapped_token"] = wrapInfo.Token
+			settings["wrapped_accessor"] = wrapInfo.WrappedAccessor
+		}
+
+		dataMap["Vault"] = settings
 	}
 
 	return dataMap, nil
 }
 
+// HandOverChildToken hands the given token over to the child: it is response-wrapped if
+// ChildTokenWrapTTL is set, and written to ChildTokenFile if set. InjectChildContext exposes
+// the wrapping token until the next hand-over.
+func (vc *Client) HandOverChildToken(token string) error {
+	handedOver := token
+
+	var wrapInfo *vaultApi.SecretWrapInfo
+	if vc.config.ChildTokenWrapTTL != "" {
+		var err error
+		wrapInfo, err = vc.wrapChildToken(token)
+		if err != nil {
+			return errors.Wrap(err, "could not wrap child token")
+		}
+
+		handedOver = wrapInfo.Token
+	}
+
+	if vc.config.ChildTokenFile != "" {
+		if err := ioutil.WriteFile(vc.config.ChildTokenFile, []byte(handedOver), 0600); err != nil {
+			return errors.Wrapf(err, "could not write child token file: %s", vc.config.ChildTokenFile)
+		}
+	}
+
+	vc.handoffLock.Lock()
+	defer vc.handoffLock.Unlock()
+
+	vc.wrappedToken = wrapInfo
+
+	return nil
+}
+
+// wrappedChildToken returns the wrapping token last handed to the child.
+func (vc *Client) wrappedChildToken() *vaultApi.SecretWrapInfo {
+	vc.handoffLock.Lock()
+	defer vc.handoffLock.Unlock()
+
+	return vc.wrappedToken
+}
+
+// childToken returns the token that is handed to the child.
+func (vc *Client) childToken() string {
+	vc.handoffLock.Lock()
+	defer vc.handoffLock.Unlock()
+
+	if vc.handoffToken != "" {
+		return vc.handoffToken
+	}
+
+	return vc.vaultClient.Token()
+}
+
+// wrapChildToken response-wraps the child token with the configured wrap TTL.
+// The wrapped response's data holds the token under the `token` key.
+func (vc *Client) wrapChildToken(token string) (*vaultApi.SecretWrapInfo, error) {
+	req := vc.vaultClient.NewRequest("POST", "/v1/sys/wrapping/wrap")
+	req.WrapTTL = vc.config.ChildTokenWrapTTL
+	if err := req.SetJSONBody(map[string]interface{}{"token": token}); err != nil {
+		return nil, errors.Wrap(err, "could not encode wrapping request")
+	}
+
+	resp, err := vc.vaultClient.RawRequest(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not wrap token")
+	}
+	defer resp.Body.Close()
+
+	sec, err := vaultApi.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse wrapping response")
+	}
+
+	if sec == nil || sec.WrapInfo == nil {
+		return nil, errors.New("wrapping response did not contain wrap info")
+	}
+
+	return sec.WrapInfo, nil
+}
+
+// Login authenticates against the auth method mounted at the given path with the given
+// login data and returns the resulting auth secret. The client's token is left unchanged.
+func (vc *Client) Login(mount string, data map[string]interface{}) (*vaultApi.Secret, error) {
+	loginPath := path.Join("auth", strings.Trim(mount, "/"), "login")
+
+	sec, err := vc.vaultClient.Logical().Write(loginPath, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not log in at path: %s", loginPath)
+	}
+
+	if sec == nil || sec.Auth == nil {
+		return nil, errors.Errorf("login at path `%s` did not return any auth data", loginPath)
+	}
+
+	return sec, nil
+}
+
+// LookupSelf looks up the token the client is currently using. Returns nil if Vault
+// refuses the lookup, which happens once the token was revoked or has expired.
+func (vc *Client) LookupSelf() (*vaultApi.Secret, error) {
+	sec, err := vc.vaultClient.Auth().Token().LookupSelf()
+	if respErr, ok := err.(*vaultApi.ResponseError); ok && respErr.StatusCode == http.StatusForbidden {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not look up own token")
+	}
+
+	return sec, nil
+}
+
+// LookupToken looks up the given token with its own permissions, as lookup-self does. Returns nil
+// if Vault refuses the lookup, which happens once the token was revoked or has expired.
+func (vc *Client) LookupToken(token string) (*vaultApi.Secret, error) {
+	req := vc.vaultClient.NewRequest("GET", "/v1/auth/token/lookup-self")
+	req.ClientToken = token
+
+	resp, err := vc.vaultClient.RawRequest(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if respErr, ok := err.(*vaultApi.ResponseError); ok && respErr.StatusCode == http.StatusForbidden {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not look up token")
+	}
+
+	sec, err := vaultApi.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse token lookup response")
+	}
+
+	return sec, nil
+}
+
+// LookupWrappingToken looks up a response-wrapping token without consuming it. Returns nil if
+// Vault reports the token as invalid, which is also the case for wrapping tokens that were already used.
+func (vc *Client) LookupWrappingToken(wrappingToken string) (*vaultApi.Secret, error) {
+	sec, err := vc.vaultClient.Logical().Write("sys/wrapping/lookup", map[string]interface{}{
+		"token": wrappingToken,
+	})
+	if respErr, ok := err.(*vaultApi.ResponseError); ok && respErr.StatusCode == http.StatusBadRequest {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not look up wrapping token")
+	}
+
+	return sec, nil
+}
+
 // ReadLogical reads the secret at a given logical path inside of Vault.
 func (vc *Client) ReadLogical(path string) (*vaultApi.Secret, error) {
 	sec, err := vc.vaultClient.Logical().Read(path)
@@ -149,6 +439,32 @@ func (vc *Client) ReadLogical(path string) (*vaultApi.Secret, error) {
 	return sec, nil
 }
 
+// RequestUpdate asks the running watcher to render and send the environment again, even
+// if none of the secrets changed.
+func (vc *Client) RequestUpdate() error {
+	secretWatcher := vc.watcher()
+	if secretWatcher == nil {
+		return errors.New("watcher has not been started")
+	}
+
+	secretWatcher.RequestUpdate()
+
+	return nil
+}
+
+// RequestRefetch asks the running watcher to fetch every leased secret again with the token
+// the client is using, and then to send the environment again.
+func (vc *Client) RequestRefetch() error {
+	secretWatcher := vc.watcher()
+	if secretWatcher == nil {
+		return errors.New("watcher has not been started")
+	}
+
+	secretWatcher.RequestRefetch()
+
+	return nil
+}
+
 // RevokeSecret revokes a leased secret.
 func (vc *Client) RevokeSecret(sec *secret.Secret) error {
 	if sec.Auth != nil {
@@ -157,6 +473,12 @@ func (vc *Client) RevokeSecret(sec *secret.Secret) error {
 			return errors.Wrapf(err, "could not get token accessor for secret loaded from path: %s", sec.Path)
 		}
 
+		// Batch tokens have no accessor and can not be revoked
+		if accessor == "" {
+			log.Warnf("Token `%s` has no accessor and can not be revoked; it will expire on its own", sec.Path)
+			return nil
+		}
+
 		return vc.RevokeTokenAccessor(accessor)
 	} else if sec.LeaseID != "" {
 		return vc.RevokeLease(sec.LeaseID)
@@ -183,9 +505,42 @@ func (vc *Client) RevokeLease(leaseID string) error {
 		return errors.Wrapf(err, "could not revoke lease by id: %s", leaseID)
 	}
 
+	vc.leasesLock.Lock()
+	delete(vc.leases, leaseID)
+	vc.leasesLock.Unlock()
+
 	return nil
 }
 
+// RevokeLeases revokes every lease obtained through FetchSecret that was not revoked yet.
+// All leases are attempted; the returned error aggregates every lease that failed.
+func (vc *Client) RevokeLeases() error {
+	vc.leasesLock.Lock()
+	leases := make(map[string]string, len(vc.leases))
+	for leaseID, path := range vc.leases {
+		leases[leaseID] = path
+	}
+	vc.leasesLock.Unlock()
+
+	var result error
+	for leaseID, path := range leases {
+		logger := log.WithFields(logrus.Fields{
+			"leaseID":    leaseID,
+			"secretPath": path,
+		})
+
+		if err := vc.RevokeLease(leaseID); err != nil {
+			logger.WithError(err).Errorf("Could not revoke lease")
+			result = multierror.Append(result, err)
+			continue
+		}
+
+		logger.Infof("Revoked lease")
+	}
+
+	return result
+}
+
 // NewLeaseRenewer creates a goroutine that constantly renews the secret lease that is configured
 // in the *vaultApi.RenewerInput.
 func (vc *Client) NewLeaseRenewer(renewerCfg *vaultApi.RenewerInput) (*vaultApi.Renewer, error) {
@@ -203,25 +558,40 @@ func (vc *Client) StartWatcher(ctx context.Context, refreshDuration time.Duratio
 	// Build an updates channel we can pass back to the supervisor
 	updateCh := make(chan []string, 1)
 
-	// Launch the watcher goroutine
+	// Send the initial update and launch the watcher goroutine
 	watcher, err := watcher.NewWatcher(vc, refreshDuration)
 	if err != nil {
 		return nil, errors.Wrap(err, "while creating watcher")
 	}
 
-	go watcher.Watch(ctx, updateCh)
+	if err := watcher.Watch(ctx, updateCh); err != nil {
+		return nil, errors.Wrap(err, "could not start watcher")
+	}
+
+	vc.secretWatcherLock.Lock()
+	vc.secretWatcher = watcher
+	vc.secretWatcherLock.Unlock()
 
 	return updateCh, nil
 }
 
-// StartSecretRenewer starts a renewer for a secret.
-func (vc *Client) StartSecretRenewer(sec *secret.Secret) error {
+// watcher returns the running watcher, or nil if it has not been started.
+func (vc *Client) watcher() *watcher.Watcher {
+	vc.secretWatcherLock.Lock()
+	defer vc.secretWatcherLock.Unlock()
+
+	return vc.secretWatcher
+}
+
+// StartSecretRenewer starts a renewer for a secret. Leased secrets that are not
+// renewable get one as well, which only waits for the lease to run out.
+func (vc *Client) StartSecretRenewer(sec *secret.Secret, done <-chan struct{}, renewedCh chan<- *secret.Renewal, expiredCh chan<- *secret.Secret) error {
 	renewable, err := sec.IsRenewable()
 	if err != nil {
 		return errors.Wrap(err, "could not check if secret is renewable")
 	}
 
-	if !renewable {
+	if !renewable && sec.LeaseID == "" {
 		log.Debugf("Secret `%s` is not renewable; skipping renewer", sec.Path)
 		return nil
 	}
@@ -233,8 +603,9 @@ func (vc *Client) StartSecretRenewer(sec *secret.Secret) error {
 		return errors.Wrap(err, "could not start secret renewer")
 	}
 
+	sec.SetRenewer(renewer)
 	go renewer.Renew()
-	go sec.WatchRenewer(renewer)
+	sec.WatchRenewer(renewer, done, renewedCh, expiredCh)
 
 	return nil
 }
@@ -246,7 +617,23 @@ func (vc *Client) StopSecretRenewer(sec *secret.Secret) error {
 		return errors.Errorf("Asked to stop renewer for secret `%v`, but renewer is nil.", renewer)
 	}
 
+	// Forget the renewer first, so that it is not taken as expired
+	sec.SetRenewer(nil)
 	renewer.Stop()
 
 	return nil
 }
+
+// Unwrap consumes a response-wrapping token and returns the wrapped response.
+func (vc *Client) Unwrap(wrappingToken string) (*vaultApi.Secret, error) {
+	sec, err := vc.vaultClient.Logical().Unwrap(wrappingToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unwrap wrapping token")
+	}
+
+	if sec == nil {
+		return nil, errors.New("unwrapping returned no response")
+	}
+
+	return sec, nil
+}
@@ -0,0 +1,140 @@
+package real
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func newTestClient(t *testing.T, server *vaulttest.Server) *Client {
+	client, err := NewClient(server.Config())
+	if err != nil {
+		t.Fatalf("could not create Vault client: %v", err)
+	}
+
+	return client.(*Client)
+}
+
+func TestRevokeLeases(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.Handle("/v1/database/creds/", func(w http.ResponseWriter, r *vaulttest.Request) {
+		role := strings.TrimPrefix(r.Path, "/v1/database/creds/")
+		fmt.Fprintf(w, `{"lease_id": "database/creds/%s/lease", "lease_duration": 3600, "renewable": true, "data": {"username": "%s"}}`, role, role)
+	})
+	server.Handle("/v1/sys/leases/revoke", func(w http.ResponseWriter, r *vaulttest.Request) {
+		if leaseID, _ := r.Body["lease_id"].(string); strings.HasPrefix(leaseID, "database/creds/broken/") {
+			vaulttest.Error(w, http.StatusForbidden, "permission denied")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	client := newTestClient(t, server)
+	for _, path := range []string{"database/creds/app", "database/creds/broken"} {
+		if _, err := client.FetchSecret(path); err != nil {
+			t.Fatalf("unexpected error fetching `%s`: %v", path, err)
+		}
+	}
+
+	err := client.RevokeLeases()
+	if err == nil || !strings.Contains(err.Error(), "database/creds/broken/lease") {
+		t.Errorf("expected aggregate error naming the lease that failed, got: %v", err)
+	}
+
+	if revoked := server.Requests("/v1/sys/leases/revoke"); len(revoked) != 2 {
+		t.Errorf("expected every lease to be revoked, got: %v", revoked.Fields("lease_id"))
+	}
+
+	if _, ok := client.leases["database/creds/broken/lease"]; !ok || len(client.leases) != 1 {
+		t.Errorf("expected only the failed lease to remain tracked, got: %v", client.leases)
+	}
+}
+
+func TestFetchSecretsRequiredAndOptional(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/kv1/shared", http.StatusOK, `{"data": {"session_key": "abcd"}}`)
+
+	client := newTestClient(t, server)
+
+	client.config.KVRaw = true
+	client.config.Paths = []string{"kv1/shared", "?kv1/missing"}
+
+	secrets, err := client.FetchSecrets()
+	if err != nil {
+		t.Fatalf("unexpected error fetching secrets: %v", err)
+	}
+
+	if len(secrets) != 2 || secrets[1].Path != "kv1/missing" || len(secrets[1].Data) != 0 {
+		t.Errorf("expected missing optional secret to be an empty entry, got: %v", secrets)
+	}
+
+	client.config.Paths = []string{"kv1/shared", "kv1/missing"}
+	if _, err := client.FetchSecrets(); err == nil || !strings.Contains(err.Error(), "kv1/missing") {
+		t.Errorf("expected missing required secret to fail with its path, got: %v", err)
+	}
+}
+
+func TestSecretRenewalsAreSentToOwner(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/sys/leases/renew", http.StatusOK, `{"lease_id": "database/creds/app/abcd", "lease_duration": 7200, "renewable": true}`)
+
+	client := newTestClient(t, server)
+
+	sec := secret.New("database/creds/app", &vaultApi.Secret{
+		LeaseID:       "database/creds/app/abcd",
+		LeaseDuration: 3600,
+		Renewable:     true,
+		Data:          map[string]interface{}{"username": "app"},
+	})
+
+	renewedCh := make(chan *secret.Renewal, 1)
+	if err := client.StartSecretRenewer(sec, nil, renewedCh, nil); err != nil {
+		t.Fatalf("unexpected error starting renewer: %v", err)
+	}
+	defer client.StopSecretRenewer(sec)
+
+	select {
+	case renewal := <-renewedCh:
+		if sec.LeaseDuration != 3600 {
+			t.Errorf("expected renewer not to modify the secret itself, got lease duration: %d", sec.LeaseDuration)
+		}
+
+		if !renewal.Apply() || sec.LeaseDuration != 7200 || sec.Data["username"] != "app" {
+			t.Errorf("expected renewal to extend the lease and keep the data, got: %d, %v", sec.LeaseDuration, sec.Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for renewal")
+	}
+}
+
+func TestCreateChildTokenWithRole(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.HandleTokens()
+
+	client := newTestClient(t, server)
+
+	client.config.TokenRole = "app/web?ttl=1h"
+	client.config.OrphanToken = true
+
+	if _, err := client.CreateChildToken("test"); err != nil {
+		t.Fatalf("unexpected error creating child token: %v", err)
+	}
+
+	created := server.Requests("/v1/auth/token/create/")
+	if len(created) != 1 || created[0].EscapedPath != "/v1/auth/token/create/app%2Fweb%3Fttl=1h" {
+		t.Fatalf("expected the token to be created at the escaped role endpoint, got: %v", created)
+	}
+
+	// The role decides whether the token is an orphan
+	if noParent, _ := created[0].Body["no_parent"].(bool); noParent {
+		t.Errorf("expected no_parent not to be set with a token role, got: %v", created[0].Body)
+	}
+}
@@ -0,0 +1,117 @@
+package real
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+)
+
+// kvDataPrefix is the path segment KV v2 serves the secret data under
+const kvDataPrefix = "data/"
+
+// kvMount describes the secrets engine mount a path was found to belong to.
+type kvMount struct {
+	// Path is the path of the mount, relative to the namespace
+	Path string
+	// Version2 is true if the mount is a KV version 2 secrets engine
+	Version2 bool
+}
+
+// lookupKVMount asks Vault which mount the given path belongs to. Results are
+// cached, since mounts rarely change. Returns nil if Vault will not tell.
+func (vc *Client) lookupKVMount(spec *secret.Spec) (*kvMount, error) {
+	cacheKey := spec.RequestPath()
+
+	vc.kvMountsLock.Lock()
+	mount, ok := vc.kvMounts[cacheKey]
+	vc.kvMountsLock.Unlock()
+
+	if ok {
+		return mount, nil
+	}
+
+	lookupPath := path.Join(spec.Namespace, "sys/internal/ui/mounts", spec.Path)
+	sec, err := vc.vaultClient.Logical().Read(lookupPath)
+	if err != nil {
+		respErr, ok := errors.Cause(err).(*vaultApi.ResponseError)
+		if !ok || (respErr.StatusCode != http.StatusForbidden && respErr.StatusCode != http.StatusNotFound) {
+			return nil, errors.Wrapf(err, "could not look up mount of path: %s", spec.Path)
+		}
+
+		log.WithField("secretPath", spec.Path).Debugf("Vault did not report the mount of path; reading it as written")
+		sec = nil
+	}
+
+	if sec != nil && sec.Data != nil {
+		mountPath, _ := sec.Data["path"].(string)
+		mountType, _ := sec.Data["type"].(string)
+		options, _ := sec.Data["options"].(map[string]interface{})
+
+		mount = &kvMount{Path: mountPath}
+		if options != nil && mountType == "kv" {
+			version, _ := options["version"].(string)
+			mount.Version2 = version == "2"
+		}
+	}
+
+	vc.kvMountsLock.Lock()
+	vc.kvMounts[cacheKey] = mount
+	vc.kvMountsLock.Unlock()
+
+	return mount, nil
+}
+
+// kvPaths splits a path inside of a KV v2 mount into the path its data is
+// read from and the logical path it is known by. Paths that already address
+// the data endpoint are accepted as well.
+func kvPaths(mountPath, secretPath string) (dataPath, logicalPath string) {
+	mountPath = strings.Trim(mountPath, "/") + "/"
+	relative := strings.TrimPrefix(strings.TrimPrefix(secretPath, "/"), mountPath)
+	relative = strings.TrimPrefix(relative, kvDataPrefix)
+
+	return mountPath + kvDataPrefix + relative, mountPath + relative
+}
+
+// resolveKVPath returns the path a secret is requested at, and, for secrets
+// in KV v2 mounts, the logical path it should be known by in the context.
+func (vc *Client) resolveKVPath(spec *secret.Spec) (requestPath, logicalPath string, kvv2 bool, err error) {
+	// Write requests are sent to the path as written
+	if vc.config.KVRaw || spec.IsWrite() {
+		return spec.RequestPath(), spec.Path, false, nil
+	}
+
+	mount, err := vc.lookupKVMount(spec)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	if mount == nil || !mount.Version2 {
+		if spec.Pinned() {
+			return "", "", false, errors.Errorf("path `%s` pins a version, but is not in a KV v2 mount", spec.Raw)
+		}
+
+		return spec.RequestPath(), spec.Path, false, nil
+	}
+
+	dataPath, logicalPath := kvPaths(mount.Path, spec.Path)
+
+	return path.Join(spec.Namespace, dataPath), logicalPath, true, nil
+}
+
+// readKVVersion reads a specific version of a KV v2 secret from its data path.
+func (vc *Client) readKVVersion(dataPath string, version int) (*vaultApi.Secret, error) {
+	sec, err := vc.vaultClient.Logical().ReadWithData(dataPath, map[string][]string{
+		"version": {strconv.Itoa(version)},
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read version %d of secret at path: %s", version, dataPath)
+	}
+
+	return sec, nil
+}
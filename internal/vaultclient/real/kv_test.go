@@ -0,0 +1,120 @@
+package real
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func newKVTestClient(t *testing.T) (*Client, *vaulttest.Server) {
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/sys/internal/ui/mounts/", http.StatusForbidden, `{"errors": ["permission denied"]}`)
+	server.Respond("/v1/sys/internal/ui/mounts/secret/", http.StatusOK, `{"data": {"path": "secret/", "type": "kv", "options": {"version": "2"}}}`)
+	server.Handle("/v1/secret/data/shared", func(w http.ResponseWriter, r *vaulttest.Request) {
+		if r.Query.Get("version") == "2" {
+			fmt.Fprint(w, `{"data": {"data": {"session_key": "old"}, "metadata": {"version": 2}}}`)
+			return
+		}
+
+		fmt.Fprint(w, `{"data": {"data": {"session_key": "abcd"}, "metadata": {"version": 3}}}`)
+	})
+	server.Respond("/v1/kv1/shared", http.StatusOK, `{"data": {"session_key": "efgh"}}`)
+
+	return newTestClient(t, server), server
+}
+
+func TestFetchSecretDetectsKVv2(t *testing.T) {
+	client, server := newKVTestClient(t)
+
+	for _, path := range []string{"/secret/shared", "secret/data/shared"} {
+		sec, err := client.FetchSecret(path)
+		if err != nil {
+			t.Fatalf("unexpected error fetching `%s`: %v", path, err)
+		}
+
+		if sec == nil {
+			t.Fatalf("expected secret at `%s` to be read from the KV v2 data endpoint, requested: %v", path, server.Requests("/"))
+		}
+
+		data, err := secret.SecretsAsMap([]*secret.Secret{sec}, secret.NestingFullPath, secret.CollisionFirstWins)
+		if err != nil {
+			t.Fatalf("unexpected error building data map: %v", err)
+		}
+
+		shared := data["secret"].(map[string]interface{})["shared"].(map[string]interface{})
+		if shared["session_key"] != "abcd" {
+			t.Errorf("expected KV v2 data of `%s` to be flattened into .secret.shared, got: %v", path, data)
+		}
+	}
+}
+
+func TestFetchSecretKeepsKVv1(t *testing.T) {
+	client, _ := newKVTestClient(t)
+
+	sec, err := client.FetchSecret("kv1/shared")
+	if err != nil {
+		t.Fatalf("unexpected error fetching secret: %v", err)
+	}
+
+	if sec == nil || sec.KVv2 || sec.Data["session_key"] != "efgh" {
+		t.Errorf("expected secret outside of a KV v2 mount to be read as written, got: %v", sec)
+	}
+}
+
+func TestFetchSecretKVRaw(t *testing.T) {
+	client, server := newKVTestClient(t)
+
+	client.config.KVRaw = true
+
+	sec, err := client.FetchSecret("secret/data/shared")
+	if err != nil {
+		t.Fatalf("unexpected error fetching secret: %v", err)
+	}
+
+	data, err := secret.SecretsAsMap([]*secret.Secret{sec}, secret.NestingFullPath, secret.CollisionFirstWins)
+	if err != nil {
+		t.Fatalf("unexpected error building data map: %v", err)
+	}
+
+	shared := data["secret"].(map[string]interface{})["data"].(map[string]interface{})["shared"].(map[string]interface{})
+	if _, ok := shared["metadata"]; !ok {
+		t.Errorf("expected raw KV v2 shape to be kept, got: %v", data)
+	}
+
+	if lookups := server.Requests("/v1/sys/internal/ui/mounts/"); len(lookups) != 0 {
+		t.Errorf("expected no mount lookup with KVRaw, got: %d", len(lookups))
+	}
+}
+
+func TestFetchSecretPinnedVersion(t *testing.T) {
+	client, _ := newKVTestClient(t)
+
+	sec, err := client.FetchSecret("secret/shared@2")
+	if err != nil {
+		t.Fatalf("unexpected error fetching pinned secret: %v", err)
+	}
+
+	if sec == nil || !sec.Pinned() || sec.Path != "secret/shared" {
+		t.Fatalf("expected pinned secret at logical path 'secret/shared', got: %v", sec)
+	}
+
+	if data, _ := sec.Data["data"].(map[string]interface{}); data["session_key"] != "old" {
+		t.Errorf("expected version 2 of the secret to be read, got: %v", sec.Data)
+	}
+
+	latest, err := client.FetchSecret("secret/shared")
+	if err != nil {
+		t.Fatalf("unexpected error fetching latest secret: %v", err)
+	}
+
+	if updated, _ := sec.Update(latest); updated {
+		t.Errorf("expected pinned secret not to be updated to the latest version")
+	}
+
+	if _, err := client.FetchSecret("kv1/shared@2"); err == nil {
+		t.Errorf("expected error pinning a version outside of a KV v2 mount")
+	}
+}
@@ -0,0 +1,102 @@
+package real
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+
+	vaultApi "github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+)
+
+// requestParamContext is the template context request parameters are
+// rendered with.
+type requestParamContext struct {
+	Env      map[string]string
+	Hostname string
+}
+
+// renderRequestParams renders the request parameters of a spec as templates.
+func renderRequestParams(spec *secret.Spec) (map[string][]string, error) {
+	if len(spec.Params) == 0 {
+		return nil, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.WithError(err).Warnf("Could not determine hostname for request parameters")
+	}
+
+	context := &requestParamContext{
+		Env:      make(map[string]string, 0),
+		Hostname: hostname,
+	}
+
+	for _, envVar := range os.Environ() {
+		pair := strings.SplitN(envVar, "=", 2)
+		context.Env[pair[0]] = pair[1]
+	}
+
+	params := make(map[string][]string, len(spec.Params))
+	for key, values := range spec.Params {
+		for _, value := range values {
+			tpl, err := template.New(key).Parse(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse template for request parameter `%s`", key)
+			}
+
+			rendered := bytes.NewBufferString("")
+			if err := tpl.Execute(rendered, context); err != nil {
+				return nil, errors.Wrapf(err, "could not render template for request parameter `%s`", key)
+			}
+
+			params[key] = append(params[key], rendered.String())
+		}
+	}
+
+	return params, nil
+}
+
+// writeRequest sends a write-style request with the given parameters as its
+// body and returns the response as a secret. Parameters given once are sent
+// as a single value.
+func (vc *Client) writeRequest(method, path string, params map[string][]string) (*vaultApi.Secret, error) {
+	body := make(map[string]interface{}, len(params))
+	for key, values := range params {
+		if len(values) == 1 {
+			body[key] = values[0]
+		} else {
+			body[key] = values
+		}
+	}
+
+	req := vc.vaultClient.NewRequest(method, "/v1/"+path)
+	if err := req.SetJSONBody(body); err != nil {
+		return nil, errors.Wrap(err, "could not encode request parameters")
+	}
+
+	resp, err := vc.vaultClient.RawRequest(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not send %s request to path: %s", method, path)
+	}
+
+	// Nothing was returned, so there is no secret
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+
+	sec, err := vaultApi.ParseSecret(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not parse response from path: %s", path)
+	}
+
+	return sec, nil
+}
@@ -0,0 +1,43 @@
+package real
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func TestFetchSecretWriteRequest(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/pki/issue/web", http.StatusOK, `{"data": {"certificate": "cert", "private_key": "key", "serial_number": "01"}}`)
+
+	client := newTestClient(t, server)
+
+	os.Setenv("VAULT_INIT_TEST_DOMAIN", "example.com")
+	defer os.Unsetenv("VAULT_INIT_TEST_DOMAIN")
+
+	sec, err := client.FetchSecret("POST:pki/issue/web?common_name=web.{{.Env.VAULT_INIT_TEST_DOMAIN}}&alt_names=a&alt_names=b")
+	if err != nil {
+		t.Fatalf("unexpected error sending write request: %v", err)
+	}
+
+	issued := server.Requests("/v1/pki/issue/web")
+	if len(issued) != 1 || issued[0].Method != http.MethodPost {
+		t.Fatalf("expected a single request to be sent as POST, got: %v", issued)
+	}
+
+	body := issued[0].Body
+
+	if body["common_name"] != "web.example.com" {
+		t.Errorf("expected templated parameter to be rendered, got: %v", body["common_name"])
+	}
+
+	if altNames, ok := body["alt_names"].([]interface{}); !ok || len(altNames) != 2 {
+		t.Errorf("expected repeated parameter to be sent as a list, got: %v", body["alt_names"])
+	}
+
+	if sec == nil || !sec.IsWrite() || sec.Path != "pki/issue/web" || sec.Data["certificate"] != "cert" {
+		t.Errorf("expected response to be loaded as the secret at 'pki/issue/web', got: %v", sec)
+	}
+}
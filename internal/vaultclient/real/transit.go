@@ -0,0 +1,52 @@
+package real
+
+import (
+	"encoding/base64"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// TransitDecrypt decrypts a batch of ciphertexts with the given transit key in
+// a single request and returns the plaintexts in the same order.
+func (vc *Client) TransitDecrypt(key string, ciphertexts []string) ([]string, error) {
+	batchInput := make([]map[string]interface{}, len(ciphertexts))
+	for idx, ciphertext := range ciphertexts {
+		batchInput[idx] = map[string]interface{}{"ciphertext": ciphertext}
+	}
+
+	decryptPath := path.Join(vc.config.TransitMount, "decrypt", key)
+	sec, err := vc.vaultClient.Logical().Write(decryptPath, map[string]interface{}{
+		"batch_input": batchInput,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decrypt with transit key: %s", key)
+	}
+
+	if sec == nil || sec.Data == nil {
+		return nil, errors.Errorf("no decryption results for transit key: %s", key)
+	}
+
+	results, _ := sec.Data["batch_results"].([]interface{})
+	if len(results) != len(ciphertexts) {
+		return nil, errors.Errorf("expected %d decryption results for transit key `%s`, got %d", len(ciphertexts), key, len(results))
+	}
+
+	plaintexts := make([]string, len(results))
+	for idx, result := range results {
+		item, _ := result.(map[string]interface{})
+		if itemErr, _ := item["error"].(string); itemErr != "" {
+			return nil, errors.Errorf("could not decrypt ciphertext %d with transit key `%s`: %s", idx, key, itemErr)
+		}
+
+		encoded, _ := item["plaintext"].(string)
+		plaintext, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not decode plaintext %d from transit key: %s", idx, key)
+		}
+
+		plaintexts[idx] = string(plaintext)
+	}
+
+	return plaintexts, nil
+}
@@ -0,0 +1,44 @@
+package real
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func TestTransitDecrypt(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.Handle("/v1/transit/decrypt/app", func(w http.ResponseWriter, r *vaulttest.Request) {
+		batch, _ := r.Body["batch_input"].([]interface{})
+
+		results := []string{}
+		for _, item := range batch {
+			ciphertext, _ := item.(map[string]interface{})["ciphertext"].(string)
+			plaintext := strings.TrimPrefix(ciphertext, "vault:v1:")
+			results = append(results, fmt.Sprintf(`{"plaintext": "%s"}`, base64.StdEncoding.EncodeToString([]byte(plaintext))))
+		}
+
+		fmt.Fprintf(w, `{"data": {"batch_results": [%s]}}`, strings.Join(results, ","))
+	})
+
+	client := newTestClient(t, server)
+
+	client.config.TransitMount = "transit"
+
+	plaintexts, err := client.TransitDecrypt("app", []string{"vault:v1:first", "vault:v1:second"})
+	if err != nil {
+		t.Fatalf("unexpected error decrypting: %v", err)
+	}
+
+	if requests := server.Requests("/v1/transit/decrypt/app"); len(requests) != 1 {
+		t.Errorf("expected ciphertexts to be decrypted in a single batch, got %d requests", len(requests))
+	}
+
+	if len(plaintexts) != 2 || plaintexts[0] != "first" || plaintexts[1] != "second" {
+		t.Errorf("expected plaintexts in request order, got: %v", plaintexts)
+	}
+}
@@ -1,6 +1,8 @@
 package real
 
 import (
+	"sync"
+
 	vaultApi "github.com/hashicorp/vault/api"
 
 	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
@@ -9,8 +11,29 @@ import (
 
 // Client is a wrapper around the Vault API client
 type Client struct {
-	config        *vaultclient.Config
-	vaultClient   *vaultApi.Client
-	tokenRenewer  *vaultApi.Renewer
-	secretWatcher *watcher.Watcher
+	config       *vaultclient.Config
+	vaultClient  *vaultApi.Client
+	tokenRenewer *vaultApi.Renewer
+
+	// secretWatcher is set once StartWatcher was called, which may happen
+	// while other goroutines request updates
+	secretWatcher     *watcher.Watcher
+	secretWatcherLock sync.Mutex
+
+	// handoffToken, if set, is handed to the child instead of the token
+	// the client is using
+	handoffToken string
+	// wrappedToken is the wrapping token last handed to the child, if
+	// ChildTokenWrapTTL is set
+	wrappedToken *vaultApi.SecretWrapInfo
+	handoffLock  sync.Mutex
+
+	// leases maps the ID of every lease obtained through FetchSecret, which
+	// has not been revoked yet, to the path of its secret
+	leases     map[string]string
+	leasesLock sync.Mutex
+
+	// kvMounts caches the mount each secret path belongs to
+	kvMounts     map[string]*kvMount
+	kvMountsLock sync.Mutex
 }
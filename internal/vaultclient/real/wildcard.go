@@ -0,0 +1,108 @@
+package real
+
+import (
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+)
+
+// kvMetadataPrefix is the path segment KV v2 lists secrets under
+const kvMetadataPrefix = "metadata/"
+
+// ExpandPaths returns the parsed configured paths, with wildcard paths replaced
+// by the specs of the secrets they match.
+func (vc *Client) ExpandPaths() ([]*secret.Spec, error) {
+	specs := make([]*secret.Spec, 0)
+	for _, raw := range vc.config.Paths {
+		spec, err := secret.ParseSpec(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse secret path: %s", raw)
+		}
+
+		if !spec.IsWildcard() {
+			specs = append(specs, spec)
+			continue
+		}
+
+		expanded, err := vc.expandWildcard(spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not expand wildcard path: %s", raw)
+		}
+
+		specs = append(specs, expanded...)
+	}
+
+	return specs, nil
+}
+
+// expandWildcard lists the parent path of a wildcard spec and returns the
+// specs of the secrets matching its pattern. Sub-folders are not descended.
+func (vc *Client) expandWildcard(spec *secret.Spec) ([]*secret.Spec, error) {
+	parent, pattern := path.Split(spec.Path)
+	listSpec := &secret.Spec{Namespace: spec.Namespace, Path: parent}
+
+	listPath, logicalParent, err := vc.resolveListPath(listSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	sec, err := vc.vaultClient.Logical().List(listPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list secrets at path: %s", listPath)
+	}
+
+	var keys []interface{}
+	if sec != nil && sec.Data != nil {
+		keys, _ = sec.Data["keys"].([]interface{})
+	}
+
+	expanded := make([]*secret.Spec, 0)
+	for _, keyIface := range keys {
+		key, _ := keyIface.(string)
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+
+		if matched, _ := path.Match(pattern, key); matched {
+			expanded = append(expanded, spec.Expand(logicalParent, key))
+		}
+	}
+
+	if len(expanded) == 0 {
+		if !spec.Optional {
+			return nil, errors.Errorf("required wildcard path `%s` did not match any secrets", spec.Raw)
+		}
+
+		log.WithField("secretPath", spec.Raw).Infof("No secrets found for optional wildcard path")
+	}
+
+	return expanded, nil
+}
+
+// resolveListPath returns the path secrets under the given parent are listed
+// at, and the logical path the listed keys are relative to. KV v2 lists its
+// secrets under the metadata endpoint.
+func (vc *Client) resolveListPath(spec *secret.Spec) (listPath, logicalParent string, err error) {
+	if vc.config.KVRaw {
+		return spec.RequestPath(), spec.Path, nil
+	}
+
+	mount, err := vc.lookupKVMount(spec)
+	if err != nil {
+		return "", "", err
+	}
+
+	if mount == nil || !mount.Version2 {
+		return spec.RequestPath(), spec.Path, nil
+	}
+
+	mountPath := strings.Trim(mount.Path, "/") + "/"
+	relative := strings.TrimPrefix(strings.TrimPrefix(spec.Path, "/"), mountPath)
+	relative = strings.TrimPrefix(relative, kvMetadataPrefix)
+	relative = strings.TrimPrefix(relative, kvDataPrefix)
+
+	return path.Join(spec.Namespace, mountPath+kvMetadataPrefix+relative), mountPath + relative, nil
+}
@@ -0,0 +1,58 @@
+package real
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func TestExpandPaths(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/sys/internal/ui/mounts/secret/services", http.StatusOK, `{"data": {"path": "secret/", "type": "kv", "options": {"version": "2"}}}`)
+	server.Respond("/v1/secret/metadata/services", http.StatusOK, `{"data": {"keys": ["api", "web-api", "web-ui", "web-db@2", "web-internal/"]}}`)
+
+	client := newTestClient(t, server)
+
+	client.config.Paths = []string{"secret/services/web-*", "kv1/shared"}
+
+	specs, err := client.ExpandPaths()
+	if err != nil {
+		t.Fatalf("unexpected error expanding paths: %v", err)
+	}
+
+	paths := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		paths = append(paths, spec.Raw)
+	}
+
+	expected := []string{"?secret/services/web-api", "?secret/services/web-ui", "?secret/services/web-db@2", "kv1/shared"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected wildcard to expand to matching secrets of the KV v2 mount, got: %v", paths)
+	}
+
+	// Keys are not parsed as spec syntax, so `@2` is part of the secret name
+	if pinned := specs[2]; pinned.Path != "secret/services/web-db@2" || pinned.Version != 0 {
+		t.Errorf("expected matched key not to be pinned to a version, got: %#v", pinned)
+	}
+}
+
+func TestExpandPathsWithoutMatches(t *testing.T) {
+	server := vaulttest.NewServer(t)
+	server.Respond("/v1/sys/internal/ui/mounts/secret/services", http.StatusOK, `{"data": {"path": "secret/", "type": "kv", "options": {"version": "2"}}}`)
+	server.Respond("/v1/secret/metadata/services", http.StatusOK, `{"data": {"keys": ["api"]}}`)
+
+	client := newTestClient(t, server)
+
+	client.config.Paths = []string{"secret/services/web-*"}
+	if _, err := client.ExpandPaths(); err == nil {
+		t.Errorf("expected error for required wildcard path without matches")
+	}
+
+	client.config.Paths = []string{"?secret/services/web-*"}
+	paths, err := client.ExpandPaths()
+	if err != nil || len(paths) != 0 {
+		t.Errorf("expected optional wildcard path without matches to expand to nothing, got: %v, %v", paths, err)
+	}
+}
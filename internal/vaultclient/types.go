@@ -5,12 +5,21 @@ import (
 	"time"
 
 	vaultApi "github.com/hashicorp/vault/api"
+	"glow.dev.maio.me/seanj/vault-init/internal/cache"
 	"glow.dev.maio.me/seanj/vault-init/internal/secret"
 )
 
 // TokenCreatorFunc is a function that returns a token that can be used by
 // the child process and by the vault-init
-type TokenCreatorFunc func(*vaultApi.TokenCreateRequest) (*vaultApi.Secret, error)
+type TokenCreatorFunc func(*TokenCreateRequest) (*vaultApi.Secret, error)
+
+// TokenCreateRequest extends `vaultApi.TokenCreateRequest` with the token
+// creation parameters it does not carry.
+type TokenCreateRequest struct {
+	vaultApi.TokenCreateRequest
+
+	BoundCIDRs []string `json:"bound_cidrs,omitempty"`
+}
 
 // Config configures the Vault client's operations
 type Config struct {
@@ -20,18 +29,82 @@ type Config struct {
 	// should be created with.
 	AccessPolicies []string
 
+	// ChildTokenFile is a path the token handed to the child is written to
+	// whenever it is handed over. Holds the wrapped token if
+	// ChildTokenWrapTTL is set.
+	ChildTokenFile string
+
+	// ChildTokenWrapTTL, if set, hands the child a response-wrapping token
+	// with this TTL instead of the raw child token. A new wrapping token is
+	// created for every new child token and every restart of the child,
+	// since each can only be unwrapped once.
+	ChildTokenWrapTTL string
+
+	// CollisionPolicy decides which value is kept when secrets set the same
+	// key in the template context, or whether to fail instead.
+	CollisionPolicy secret.CollisionPolicy
+
+	// ContextNesting is the strategy for choosing the keys each secret's
+	// data is nested under in the template context.
+	ContextNesting secret.ContextNesting
+
+	// ContextCache, if set, receives the template context every time it is
+	// built from Vault, so that vault-init can start while Vault is down.
+	ContextCache *cache.Cache
+
 	// DisableTokenRenew defines the "renewability" of the token. If true,
 	// sets the `renewable` flag to false on token creation.
 	DisableTokenRenew bool
 
+	// KVRaw disables KV v2 detection. Paths are read as written and KV v2
+	// secrets keep the `data` and `metadata` nesting of the KV v2 API.
+	KVRaw bool
+
+	// LeaseRevokeGrace is how long the previous lease of a dynamic secret
+	// stays valid after the secret was fetched again, giving the child time
+	// to switch over to the new credentials.
+	LeaseRevokeGrace time.Duration
+
+	// Namespace is the Vault Enterprise namespace the client, and with it
+	// the child token, operates in.
+	Namespace string
+
 	// NoInheritToken controls whether the vaultclient sends VAULT_TOKEN
 	// and Vault settings to the child process
 	NoInheritToken bool
 
+	// TokenBoundCIDRs restricts the child token to be used only from the
+	// given CIDR blocks.
+	TokenBoundCIDRs []string
+
+	// TokenEntityAlias is the entity alias the child token is associated
+	// with. Only allowed together with a TokenRole.
+	TokenEntityAlias string
+
+	// TokenExplicitMaxTTL is a hard limit on the child token's lifetime,
+	// which renewals can not extend.
+	TokenExplicitMaxTTL string
+
+	// TokenMetadata is attached to the child token and shows up in Vault's
+	// audit log, identifying which container owns the token.
+	TokenMetadata map[string]string
+
+	// TokenNumUses limits the number of requests the token handed to the
+	// child may make. The child then gets a separate token, since
+	// vault-init keeps using the child token itself.
+	TokenNumUses int
+
+	// TokenType is the type of the child token, either `service` or `batch`.
+	TokenType string
+
 	// OrphanToken defines whether the created token should be an orphan
 	// or not.
 	OrphanToken bool
 
+	// PKIRenewFraction is the fraction of an issued certificate's lifetime
+	// after which it is issued again.
+	PKIRenewFraction float64
+
 	// Paths is a list of paths that should be inserted into the template
 	// context from Vault.
 	Paths []string
@@ -41,8 +114,17 @@ type Config struct {
 	// requires a root/sudo token
 	TokenPeriod string
 
+	// TokenRole is the name of the token role the child token is created
+	// against. When set, AccessPolicies must be allowed by the role and
+	// the role decides whether the token is an orphan.
+	TokenRole string
+
 	// TokenTTL defaults the lifetime of the token
 	TokenTTL string
+
+	// TransitMount is the path the transit secrets engine used to decrypt
+	// ciphertext in templates is mounted at.
+	TransitMount string
 }
 
 // VaultClient is an interface defining the functions required to be
@@ -54,33 +136,76 @@ type VaultClient interface {
 	// This token is provided to the application that is running underneath vault-init, that way the token
 	// used by vault-init itself is never exposed to the managed application.
 	CreateChildToken(string) (*vaultApi.Secret, error)
+	// CreateHandoffToken creates a non-renewable token limited to TokenNumUses, which is handed to the
+	// application instead of the child token, so that vault-init's own requests do not use it up.
+	CreateHandoffToken(string) (*vaultApi.Secret, error)
+	// ExpandPaths returns the parsed configured paths, with wildcard paths replaced by the specs of
+	// the secrets they match.
+	ExpandPaths() ([]*secret.Spec, error)
 	// FetchSecret fetches a secret from Vault, wrapping it into a *secret.Secret.
 	FetchSecret(string) (*secret.Secret, error)
-	// FetchSecrets fetches all of the secrets defined in the configuration.
+	// FetchSpec fetches the secret described by a parsed path from Vault, wrapping it into a *secret.Secret.
+	FetchSpec(*secret.Spec) (*secret.Secret, error)
+	// FetchSecrets fetches all of the secrets defined in the configuration, expanding wildcard paths.
 	FetchSecrets() ([]*secret.Secret, error)
 	// GetConfig returns the loaded config.
 	GetConfig() *Config
+	// HandOverChildToken hands the given token over to the child: it is response-wrapped if
+	// ChildTokenWrapTTL is set, and written to ChildTokenFile if set. InjectChildContext exposes
+	// the wrapping token until the next hand-over.
+	HandOverChildToken(string) error
 	// InjectChildContext inserts context into the pre-environment data-map
 	// to provide Vault context, etc, to the child process.
 	InjectChildContext(map[string]interface{}) (map[string]interface{}, error)
+	// Login authenticates against the auth method mounted at the given path with the given
+	// login data and returns the resulting auth secret. The client's token is left unchanged.
+	Login(string, map[string]interface{}) (*vaultApi.Secret, error)
+	// LookupSelf looks up the token the client is currently using. Returns nil if Vault reports
+	// the token as invalid, such as when it was revoked or has expired.
+	LookupSelf() (*vaultApi.Secret, error)
+	// LookupToken looks up the given token with its own permissions, as lookup-self does. Returns nil
+	// if Vault reports the token as invalid, such as when it was revoked or has expired.
+	LookupToken(string) (*vaultApi.Secret, error)
+	// LookupWrappingToken looks up the given response-wrapping token without consuming it. Returns
+	// nil if the token is not a valid wrapping token, which includes wrapping tokens that were already used.
+	LookupWrappingToken(string) (*vaultApi.Secret, error)
 	// NewLeaseRenewer creates a goroutine that constantly renews the secret lease that is configured
 	// in the *vaultApi.RenewerInput.
 	NewLeaseRenewer(*vaultApi.RenewerInput) (*vaultApi.Renewer, error)
+	// RequestUpdate asks the running watcher to render and send the environment again, even
+	// if none of the secrets changed.
+	RequestUpdate() error
+	// RequestRefetch asks the running watcher to fetch every leased secret again with the token
+	// the client is using, and then to send the environment again.
+	RequestRefetch() error
 	// RevokeSecret revokes a leased secret.
 	RevokeSecret(*secret.Secret) error
 	// RevokeTokenAccessor takes a token's accessor and revokes it.
 	RevokeTokenAccessor(string) error
 	// RevokeLease takes a lease ID and revokes it.
 	RevokeLease(string) error
+	// RevokeLeases revokes every lease obtained through FetchSecret that was not revoked yet.
+	RevokeLeases() error
 	// ReadLogical reads the secret at a given logical path inside of Vault.
 	ReadLogical(string) (*vaultApi.Secret, error)
+	// SetHandoffToken sets the token handed to the application instead of the token the client is
+	// using. An empty token hands the client's token over.
+	SetHandoffToken(string)
 	// SetToken sets the token that should be used to authenticate to Vault.
 	SetToken(string) error
 	// StartWatcher starts the client's secret watcher. The resulting string channel will receive
-	// a string array of rendered environment variables when updates happen.
+	// a string array of rendered environment variables when updates happen. Fails if the initial
+	// update, which is sent before it returns, could not be fetched or rendered.
 	StartWatcher(context.Context, time.Duration) (chan []string, error)
-	// StartSecretRenewer starts a renewer for the given secret.
-	StartSecretRenewer(*secret.Secret) error
+	// StartSecretRenewer starts a renewer for the given secret. Renewals are sent to the first channel,
+	// and the secret is sent to the second once its lease can no longer be renewed. Sends are given up
+	// once the done channel is closed.
+	StartSecretRenewer(*secret.Secret, <-chan struct{}, chan<- *secret.Renewal, chan<- *secret.Secret) error
 	// StopSecretRenewer stops a renewer for the given secret.
 	StopSecretRenewer(*secret.Secret) error
+	// TransitDecrypt decrypts a batch of ciphertexts with the given transit key and returns the
+	// plaintexts in the same order.
+	TransitDecrypt(string, []string) ([]string, error)
+	// Unwrap consumes the given response-wrapping token and returns the wrapped response.
+	Unwrap(string) (*vaultApi.Secret, error)
 }
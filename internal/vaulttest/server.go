@@ -0,0 +1,230 @@
+// Package vaulttest provides a fake Vault server for tests.
+package vaulttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+)
+
+// HandlerFunc answers a request to the fake Vault server.
+type HandlerFunc func(w http.ResponseWriter, r *Request)
+
+// Request is a request received by the fake Vault server.
+type Request struct {
+	Method string
+	// Path is the unescaped request path, including the `/v1` prefix
+	Path string
+	// EscapedPath is the path as it was sent
+	EscapedPath string
+	Query       url.Values
+	Token       string
+	// Body is the decoded JSON body, if there was one
+	Body map[string]interface{}
+}
+
+// Requests is a list of requests received by the fake Vault server.
+type Requests []*Request
+
+// Tokens returns the token each request was sent with.
+func (rs Requests) Tokens() []string {
+	tokens := make([]string, 0, len(rs))
+	for _, r := range rs {
+		tokens = append(tokens, r.Token)
+	}
+
+	return tokens
+}
+
+// Fields returns the value of the given body field of each request, formatted
+// as a string. Missing fields are empty.
+func (rs Requests) Fields(field string) []string {
+	values := make([]string, 0, len(rs))
+	for _, r := range rs {
+		value := ""
+		if v, ok := r.Body[field]; ok {
+			value = fmt.Sprint(v)
+		}
+
+		values = append(values, value)
+	}
+
+	return values
+}
+
+// Server is a fake Vault server. Requests are answered by the handler
+// registered for their path and recorded, so that tests can check what was
+// sent to Vault.
+type Server struct {
+	*httptest.Server
+
+	// lock guards all of the fields below
+	lock     sync.Mutex
+	handlers map[string]HandlerFunc
+	requests Requests
+	down     bool
+	// failures holds the number of requests to fail for a path
+	failures map[string]int
+
+	// tokens holds the state of HandleTokens
+	tokens *tokenStore
+}
+
+// NewServer starts a fake Vault server that answers health checks. It is
+// closed when the test ends.
+func NewServer(t *testing.T) *Server {
+	s := &Server{
+		handlers: make(map[string]HandlerFunc),
+		failures: make(map[string]int),
+	}
+
+	s.Respond("/v1/sys/health", http.StatusOK, `{"initialized": true, "sealed": false, "standby": false}`)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Config returns a Vault client configuration for the server, which does not
+// retry failed requests.
+func (s *Server) Config() *vaultclient.Config {
+	config := vaultclient.NewConfigWithDefaults()
+	config.Address = s.URL
+	config.MaxRetries = 0
+
+	return config
+}
+
+// Handle registers the handler for requests to path. A path ending in `/`
+// handles every path below it as well, unless a longer path matches.
+func (s *Server) Handle(path string, handler HandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.handlers[path] = handler
+}
+
+// Respond registers a handler that answers requests to path with the given
+// status and JSON body.
+func (s *Server) Respond(path string, status int, body string) {
+	s.Handle(path, func(w http.ResponseWriter, r *Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	})
+}
+
+// Fail makes the server fail the next count requests to path, which is
+// matched exactly.
+func (s *Server) Fail(path string, count int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failures[path] = count
+}
+
+// SetDown makes the server fail every request while down is set. Requests
+// are not recorded while the server is down.
+func (s *Server) SetDown(down bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.down = down
+}
+
+// Requests returns the requests received for path in the order they were
+// received, with the same matching as Handle.
+func (s *Server) Requests(path string) Requests {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requests := make(Requests, 0)
+	for _, r := range s.requests {
+		if matches(path, r.Path) {
+			requests = append(requests, r)
+		}
+	}
+
+	return requests
+}
+
+// Error answers a request with a Vault error response.
+func Error(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors": [%q]}`, message)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &Request{
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		EscapedPath: r.URL.EscapedPath(),
+		Query:       r.URL.Query(),
+		Token:       r.Header.Get("X-Vault-Token"),
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req.Body); err != nil {
+			Error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	s.lock.Lock()
+	down := s.down
+	if !down {
+		s.requests = append(s.requests, req)
+	}
+
+	fail := !down && s.failures[req.Path] > 0
+	if fail {
+		s.failures[req.Path]--
+	}
+
+	handler := s.handlerFor(req.Path)
+	s.lock.Unlock()
+
+	switch {
+	case down:
+		Error(w, http.StatusInternalServerError, "vault is down")
+	case fail:
+		Error(w, http.StatusInternalServerError, "internal error")
+	case handler == nil:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errors": []}`)
+	default:
+		handler(w, req)
+	}
+}
+
+// handlerFor returns the handler of the longest path matching the request
+// path. The lock must be held.
+func (s *Server) handlerFor(requestPath string) HandlerFunc {
+	var handler HandlerFunc
+	longest := -1
+	for path, h := range s.handlers {
+		if matches(path, requestPath) && len(path) > longest {
+			handler, longest = h, len(path)
+		}
+	}
+
+	return handler
+}
+
+func matches(path, requestPath string) bool {
+	if strings.HasSuffix(path, "/") {
+		return strings.HasPrefix(requestPath, path)
+	}
+
+	return path == requestPath
+}
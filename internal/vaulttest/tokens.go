@@ -0,0 +1,84 @@
+package vaulttest
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// tokenStore is a minimal model of Vault's token auth method.
+type tokenStore struct {
+	created int
+	// accessors maps the accessor of every created token to the token
+	accessors map[string]string
+	revoked   map[string]bool
+}
+
+// HandleTokens registers handlers modelling the token auth method. Created
+// tokens are named `child-N`, with the accessor `accessor-N`. Any token that
+// was not revoked is valid, and no token is a response-wrapping token.
+func (s *Server) HandleTokens() {
+	s.lock.Lock()
+	s.tokens = &tokenStore{
+		accessors: make(map[string]string),
+		revoked:   make(map[string]bool),
+	}
+	s.lock.Unlock()
+
+	for _, path := range []string{"/v1/auth/token/create", "/v1/auth/token/create/", "/v1/auth/token/create-orphan"} {
+		s.Handle(path, s.createToken)
+	}
+
+	s.Handle("/v1/auth/token/lookup-self", s.lookupSelf)
+	s.Handle("/v1/auth/token/revoke-accessor", s.revokeAccessor)
+	s.Respond("/v1/sys/wrapping/lookup", http.StatusBadRequest, `{"errors": ["wrapping token is not valid or does not exist"]}`)
+}
+
+// RevokeToken revokes a token, as if it was revoked outside of vault-init.
+func (s *Server) RevokeToken(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokens.revoked[token] = true
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *Request) {
+	s.lock.Lock()
+	s.tokens.created++
+	token := fmt.Sprintf("child-%d", s.tokens.created)
+	accessor := fmt.Sprintf("accessor-%d", s.tokens.created)
+	s.tokens.accessors[accessor] = token
+	s.lock.Unlock()
+
+	fmt.Fprintf(w, `{"auth": {"client_token": %q, "accessor": %q}}`, token, accessor)
+}
+
+func (s *Server) lookupSelf(w http.ResponseWriter, r *Request) {
+	s.lock.Lock()
+	revoked := s.tokens.revoked[r.Token]
+	accessor := "accessor-" + r.Token
+	for a, token := range s.tokens.accessors {
+		if token == r.Token {
+			accessor = a
+		}
+	}
+	s.lock.Unlock()
+
+	if revoked {
+		Error(w, http.StatusForbidden, "permission denied")
+		return
+	}
+
+	fmt.Fprintf(w, `{"data": {"accessor": %q, "ttl": 0, "renewable": false}}`, accessor)
+}
+
+func (s *Server) revokeAccessor(w http.ResponseWriter, r *Request) {
+	accessor, _ := r.Body["accessor"].(string)
+
+	s.lock.Lock()
+	if token, ok := s.tokens.accessors[accessor]; ok {
+		s.tokens.revoked[token] = true
+	}
+	s.lock.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
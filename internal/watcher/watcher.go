@@ -16,39 +16,149 @@ import (
 type Watcher struct {
 	client          vaultclient.VaultClient
 	refreshDuration time.Duration
+
+	// updateRequestCh receives requests to send the environment again
+	updateRequestCh chan struct{}
+	// refetchRequestCh receives requests to fetch leased secrets again
+	refetchRequestCh chan struct{}
+
+	// renewedCh receives lease renewals, which are applied by the watch loop
+	// so that secrets are only ever modified from a single goroutine
+	renewedCh chan *secret.Renewal
+	// expiredCh receives secrets whose lease can no longer be renewed
+	expiredCh chan *secret.Secret
+	// done is closed once the watcher exits, so that renewers stop sending
+	done <-chan struct{}
+	// expired holds secrets whose lease ran out, but could not be fetched again yet
+	expired map[*secret.Secret]bool
+	// revokeTimers revoke the previous leases of re-fetched secrets
+	revokeTimers []*time.Timer
 }
 
 func NewWatcher(client vaultclient.VaultClient, refreshDuration time.Duration) (*Watcher, error) {
 	return &Watcher{
-		client:          client,
-		refreshDuration: refreshDuration,
+		client:           client,
+		refreshDuration:  refreshDuration,
+		updateRequestCh:  make(chan struct{}, 1),
+		refetchRequestCh: make(chan struct{}, 1),
+		expired:          make(map[*secret.Secret]bool),
 	}, nil
 }
 
-// Watch watches the secrets held in Client, sending updates through the update channel
-func (w *Watcher) Watch(ctx context.Context, updateCh chan []string) {
+// RequestUpdate asks the watcher to send the environment to the supervisor
+// again, even if no secret has changed. Does not block; requests made while
+// one is already pending are merged.
+func (w *Watcher) RequestUpdate() {
+	select {
+	case w.updateRequestCh <- struct{}{}:
+	default:
+	}
+}
+
+// RequestRefetch asks the watcher to fetch every leased secret again and send
+// the environment to the supervisor, so that the leases are owned by the
+// token the client currently uses. Does not block; requests made while one is
+// already pending are merged.
+func (w *Watcher) RequestRefetch() {
+	select {
+	case w.refetchRequestCh <- struct{}{}:
+	default:
+	}
+}
+
+// Watch fetches the secrets held in Client and sends them through the update
+// channel as the initial update, then watches them for updates in the
+// background until the context is done. Returns an error if the initial
+// update could not be sent, so that starting the watcher can be retried.
+func (w *Watcher) Watch(ctx context.Context, updateCh chan []string) error {
 	log.Infof("Watching secrets for updates every %s", w.refreshDuration.String())
 
-	// Do the initial fetch and send it as an initial update to
-	// the supervisor
 	secrets, err := w.client.FetchSecrets()
 	if err != nil {
-		log.WithError(err).Fatalf("Could not collect secrets while starting watcher")
+		return errors.Wrap(err, "could not collect secrets")
+	}
+
+	// Keep the leases of renewable secrets alive for as long as we run. Each
+	// secret has at most one renewer, so sends on expiredCh do not block
+	// unless wildcard paths added secrets since, and renewers give up their
+	// sends once the watcher exits.
+	w.renewedCh = make(chan *secret.Renewal, len(secrets))
+	w.expiredCh = make(chan *secret.Secret, len(secrets))
+	w.done = ctx.Done()
+	w.startRenewers(secrets)
+
+	if err := w.sendSecrets(updateCh, secrets); err != nil {
+		w.stopRenewers(secrets)
+		return errors.Wrap(err, "could not send initial secrets")
 	}
 
-	w.sendSecrets(updateCh, secrets)
+	go w.watch(ctx, updateCh, secrets)
+
+	return nil
+}
+
+// watch keeps the secrets up to date, sending updates through the update
+// channel, until the context is done.
+func (w *Watcher) watch(ctx context.Context, updateCh chan []string, secrets []*secret.Secret) {
+	// Wildcard paths are expanded again on every refresh
+	hasWildcards := w.hasWildcards()
 
+	// Other events must not delay the refresh, so the ticker is shared by
+	// all iterations
+	ticker := time.NewTicker(w.refreshDuration)
+	defer ticker.Stop()
+
+	var err error
 	for {
 		select {
 		case <-ctx.Done():
 			log.Infof("Secret watcher exiting")
+			w.stopRenewers(secrets)
+			w.stopRevokeTimers()
 			return
-		case <-time.After(w.refreshDuration):
-			updated, err := w.checkSecrets(secrets)
+		case renewal := <-w.renewedCh:
+			if renewal.Apply() {
+				log.WithField("secretPath", renewal.Secret.Path).Debugf("Applied lease renewal")
+			}
+		case sec := <-w.expiredCh:
+			if err := w.replaceExpiredSecret(sec); err != nil {
+				log.WithField("secretPath", sec.Path).WithError(err).Errorf("Could not replace expired secret; retrying on next refresh")
+				continue
+			}
+
+			if err := w.sendSecrets(updateCh, secrets); err != nil {
+				log.WithError(err).Errorf("Could not send secrets update")
+			}
+		case <-w.updateRequestCh:
+			if err := w.sendSecrets(updateCh, secrets); err != nil {
+				log.WithError(err).Errorf("Could not send requested secrets update")
+			}
+		case <-w.refetchRequestCh:
+			w.refetchLeasedSecrets(secrets)
+
+			if err := w.sendSecrets(updateCh, secrets); err != nil {
+				log.WithError(err).Errorf("Could not send requested secrets update")
+			}
+		case <-ticker.C:
+			updated := w.retryExpiredSecrets()
+
+			if hasWildcards {
+				var synced bool
+				secrets, synced, err = w.syncPaths(secrets)
+				if err != nil {
+					log.WithError(err).Errorf("Could not expand wildcard paths")
+				}
+
+				updated = updated || synced
+			}
+
+			checked, err := w.checkSecrets(secrets)
 			if err != nil {
 				log.WithError(err).Errorf("Could not check secrets")
 			}
 
+			updated = updated || checked
+
 			if updated {
 				err := w.sendSecrets(updateCh, secrets)
 				if err != nil {
@@ -62,28 +172,67 @@ func (w *Watcher) Watch(ctx context.Context, updateCh chan []string) {
 }
 
 // checkSecrets iterates over all known secrets. _Only_ non-renewable
-// secrets need to be monitored.
+// secrets need to be monitored. Leased secrets are fetched again once their
+// renewer finishes.
 func (w *Watcher) checkSecrets(secrets []*secret.Secret) (bool, error) {
 	log.Debugf("Checking secret versions")
 
 	updated := false
 
 	for _, sec := range secrets {
+		// Issue certificates from write requests again once they are due,
+		// including leased ones, as renewing a lease does not extend them
+		if sec.IsWrite() {
+			due, err := w.certificateDue(sec)
+			if err != nil {
+				log.WithField("secretPath", sec.Path).WithError(err).Errorf("Could not check certificate expiry")
+				continue
+			}
+
+			if due {
+				if err := w.replaceExpiredSecret(sec); err != nil {
+					log.WithField("secretPath", sec.Path).WithError(err).Errorf("Could not issue certificate again; retrying on next refresh")
+					continue
+				}
+
+				updated = true
+				continue
+			}
+		}
+
 		// Skip renewable secrets
 		renewable, err := sec.IsRenewable()
-		if renewable {
+		if renewable || sec.LeaseID != "" {
 			log.WithField("secretPath", sec.Path).Debugf("Skipping secret as it is renewable")
 			continue
 		} else if err != nil {
 			return false, errors.Wrapf(err, "could not check if secret `%s` is renewable", sec.Path)
 		}
 
-		nextSecret, err := w.client.FetchSecret(sec.Path)
+		// Skip secrets pinned to a version, which never change
+		if sec.Pinned() {
+			log.WithField("secretPath", sec.Path).Debugf("Skipping secret as its version is pinned")
+			continue
+		}
+
+		// Skip secrets from write requests, which would issue a new secret
+		// on every check
+		if sec.IsWrite() {
+			log.WithField("secretPath", sec.Path).Debugf("Skipping secret as it was issued by a write request")
+			continue
+		}
+
+		nextSecret, err := w.fetchAgain(sec)
 		if err != nil {
 			log.WithField("secretPath", sec.Path).WithError(err).Errorf("Error fetching secret for update check")
 			return false, errors.Wrapf(err, "could not fetch secret `%s` for update check", sec.Path)
 		}
 
+		if nextSecret == nil {
+			log.WithField("secretPath", sec.Path).Errorf("Required secret has disappeared; keeping the previous version")
+			continue
+		}
+
 		didUpdate, err := sec.Update(nextSecret)
 		if err != nil {
 			log.WithField("secretPath", sec.Path).WithError(err).Errorf("Error checking secret for updates")
@@ -92,6 +241,7 @@ func (w *Watcher) checkSecrets(secrets []*secret.Secret) (bool, error) {
 
 		if didUpdate {
 			log.WithField("secretPath", sec.Path).Debugf("Update found for secrets")
+			w.replaceRenewer(sec)
 			updated = true
 		}
 	}
@@ -99,24 +249,255 @@ func (w *Watcher) checkSecrets(secrets []*secret.Secret) (bool, error) {
 	return updated, nil
 }
 
+// hasWildcards returns true if any of the configured paths is a wildcard.
+func (w *Watcher) hasWildcards() bool {
+	for _, raw := range w.client.GetConfig().Paths {
+		if spec, err := secret.ParseSpec(raw); err == nil && spec.IsWildcard() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// syncPaths expands the configured paths again, fetching the secrets of paths
+// that were added and dropping the secrets of paths that went away. Returns
+// the resulting secrets, and whether any were added or dropped.
+func (w *Watcher) syncPaths(secrets []*secret.Secret) ([]*secret.Secret, bool, error) {
+	specs, err := w.client.ExpandPaths()
+	if err != nil {
+		return secrets, false, errors.Wrap(err, "could not expand secret paths")
+	}
+
+	wanted := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		wanted[spec.Raw] = true
+	}
+
+	changed := false
+	known := make(map[string]bool, len(secrets))
+	synced := make([]*secret.Secret, 0, len(specs))
+	for _, sec := range secrets {
+		if !wanted[sec.Source()] {
+			log.WithField("secretPath", sec.Path).Infof("Secret path went away; removing secret")
+			w.removeSecret(sec)
+			changed = true
+			continue
+		}
+
+		known[sec.Source()] = true
+		synced = append(synced, sec)
+	}
+
+	for _, spec := range specs {
+		if known[spec.Raw] {
+			continue
+		}
+
+		sec, err := w.client.FetchSpec(spec)
+		if err != nil {
+			log.WithField("secretPath", spec.Raw).WithError(err).Errorf("Could not fetch secret of new path")
+			continue
+		}
+
+		if sec == nil {
+			continue
+		}
+
+		log.WithField("secretPath", sec.Path).Infof("Found new secret path; adding secret")
+		w.startRenewers([]*secret.Secret{sec})
+		synced = append(synced, sec)
+		changed = true
+	}
+
+	return synced, changed, nil
+}
+
+// fetchAgain fetches the current version of a secret. Secrets matched by a
+// wildcard are fetched from their spec, as their source is not parsed again.
+func (w *Watcher) fetchAgain(sec *secret.Secret) (*secret.Secret, error) {
+	if sec.Spec != nil {
+		return w.client.FetchSpec(sec.Spec)
+	}
+
+	return w.client.FetchSecret(sec.Path)
+}
+
+// removeSecret stops the renewer of a secret that is no longer wanted, and
+// revokes its lease after the grace period.
+func (w *Watcher) removeSecret(sec *secret.Secret) {
+	w.stopRenewers([]*secret.Secret{sec})
+	delete(w.expired, sec)
+
+	if sec.LeaseID != "" {
+		w.revokeAfterGrace(sec.LeaseID)
+	}
+}
+
+// replaceExpiredSecret fetches a secret again whose lease can no longer be
+// renewed, or whose certificate is due. A previous lease is revoked after the
+// grace period.
+func (w *Watcher) replaceExpiredSecret(sec *secret.Secret) error {
+	log.WithField("secretPath", sec.Path).Infof("Secret is expiring; fetching a new one")
+
+	// Retry on the next refresh, unless the replacement succeeds
+	w.expired[sec] = true
+
+	nextSecret, err := w.fetchAgain(sec)
+	if err != nil {
+		return errors.Wrapf(err, "could not fetch secret `%s`", sec.Path)
+	}
+
+	if nextSecret == nil {
+		return errors.Errorf("required secret `%s` has disappeared", sec.Path)
+	}
+
+	previousLeaseID := sec.LeaseID
+	sec.Replace(nextSecret)
+	delete(w.expired, sec)
+
+	w.replaceRenewer(sec)
+
+	if previousLeaseID != "" && previousLeaseID != sec.LeaseID {
+		w.revokeAfterGrace(previousLeaseID)
+	}
+
+	return nil
+}
+
+// refetchLeasedSecrets fetches every secret that holds a lease again. Secrets
+// that could not be fetched are retried on the next refresh.
+func (w *Watcher) refetchLeasedSecrets(secrets []*secret.Secret) {
+	for _, sec := range secrets {
+		if sec.LeaseID == "" {
+			continue
+		}
+
+		if err := w.replaceExpiredSecret(sec); err != nil {
+			log.WithField("secretPath", sec.Path).WithError(err).Errorf("Could not fetch leased secret again; retrying on next refresh")
+		}
+	}
+}
+
+// certificateDue returns true if the secret holds a certificate that has
+// reached the configured fraction of its lifetime.
+func (w *Watcher) certificateDue(sec *secret.Secret) (bool, error) {
+	if !sec.IsCertificate() {
+		return false, nil
+	}
+
+	renewAt, err := sec.CertificateRenewAt(w.client.GetConfig().PKIRenewFraction)
+	if err != nil {
+		return false, err
+	}
+
+	return !time.Now().Before(renewAt), nil
+}
+
+// retryExpiredSecrets attempts to replace the expired secrets that could not
+// be fetched again before. Returns true if any secret was replaced.
+func (w *Watcher) retryExpiredSecrets() bool {
+	replaced := false
+
+	for sec := range w.expired {
+		if err := w.replaceExpiredSecret(sec); err != nil {
+			log.WithField("secretPath", sec.Path).WithError(err).Errorf("Could not replace expired secret")
+			continue
+		}
+
+		replaced = true
+	}
+
+	return replaced
+}
+
+// revokeAfterGrace revokes a lease once the configured grace period has
+// passed. Leases still pending at exit are revoked along with all others.
+func (w *Watcher) revokeAfterGrace(leaseID string) {
+	grace := w.client.GetConfig().LeaseRevokeGrace
+	log.WithField("leaseID", leaseID).Debugf("Revoking previous lease in %s", grace.String())
+
+	timer := time.AfterFunc(grace, func() {
+		if err := w.client.RevokeLease(leaseID); err != nil {
+			log.WithField("leaseID", leaseID).WithError(err).Errorf("Could not revoke previous lease")
+			return
+		}
+
+		log.WithField("leaseID", leaseID).Debugf("Revoked previous lease")
+	})
+
+	w.revokeTimers = append(w.revokeTimers, timer)
+}
+
+// stopRevokeTimers cancels all pending lease revocations.
+func (w *Watcher) stopRevokeTimers() {
+	for _, timer := range w.revokeTimers {
+		timer.Stop()
+	}
+
+	w.revokeTimers = nil
+}
+
+// startRenewers starts a renewer for each renewable secret.
+func (w *Watcher) startRenewers(secrets []*secret.Secret) {
+	for _, sec := range secrets {
+		if err := w.client.StartSecretRenewer(sec, w.done, w.renewedCh, w.expiredCh); err != nil {
+			log.WithField("secretPath", sec.Path).WithError(err).Errorf("Could not start secret renewer")
+		}
+	}
+}
+
+// stopRenewers stops the renewers of all secrets that still have one.
+func (w *Watcher) stopRenewers(secrets []*secret.Secret) {
+	for _, sec := range secrets {
+		if sec.GetRenewer() == nil {
+			continue
+		}
+
+		if err := w.client.StopSecretRenewer(sec); err != nil {
+			log.WithField("secretPath", sec.Path).WithError(err).Errorf("Could not stop secret renewer")
+		}
+	}
+}
+
+// replaceRenewer stops the renewer of a secret that has been replaced and
+// starts a renewer for its new lease, if it is renewable.
+func (w *Watcher) replaceRenewer(sec *secret.Secret) {
+	w.stopRenewers([]*secret.Secret{sec})
+	w.startRenewers([]*secret.Secret{sec})
+}
+
 // sendSecrets serializes all known secrets into environment templates
 // and sends them as an update to the supervisor
 func (w *Watcher) sendSecrets(updateCh chan []string, secrets []*secret.Secret) error {
-	dataMap, err := secret.SecretsAsMap(secrets)
+	dataMap, err := secret.SecretsAsMap(secrets, w.client.GetConfig().ContextNesting, w.client.GetConfig().CollisionPolicy)
 	if err != nil {
 		return errors.Wrap(err, "could not convert secrets into data map")
 	}
 
+	// The child context is injected into the data map, so keep the secrets
+	// on their own for the cache
+	secretsMap := make(map[string]interface{}, len(dataMap))
+	for key, value := range dataMap {
+		secretsMap[key] = value
+	}
+
 	dataMap, err = w.client.InjectChildContext(dataMap)
 	if err != nil {
 		return errors.Wrap(err, "could not inject child context from client")
 	}
 
-	environ, err := template.RenderEnvironmentFromDataMap(w.client.GetConfig(), dataMap)
+	environ, plaintexts, err := template.RenderEnvironmentWithPlaintexts(w.client, dataMap)
 	if err != nil {
 		return errors.Wrap(err, "could not convert secrets into environment map")
 	}
 
+	if contextCache := w.client.GetConfig().ContextCache; contextCache != nil {
+		if err := contextCache.Save(secretsMap, plaintexts); err != nil {
+			log.WithError(err).Errorf("Could not save template context to cache")
+		}
+	}
+
 	vars := make([]string, 0)
 	for key, value := range environ {
 		vars = append(vars, strings.Join([]string{key, value}, "="))
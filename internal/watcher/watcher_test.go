@@ -0,0 +1,207 @@
+package watcher
+
+import (
+	"testing"
+	"time"
+
+	vaultApi "github.com/hashicorp/vault/api"
+
+	"glow.dev.maio.me/seanj/vault-init/internal/secret"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaultclient/dummy"
+	"glow.dev.maio.me/seanj/vault-init/internal/vaulttest"
+)
+
+func TestReplaceExpiredSecret(t *testing.T) {
+	cfg := vaultclient.NewConfigWithDefaults()
+	cfg.LeaseRevokeGrace = 10 * time.Millisecond
+
+	// Every fetch hands out a new lease
+	client := dummy.NewFake(cfg)
+	client.Issue = func(spec *secret.Spec) *vaultApi.Secret {
+		return &vaultApi.Secret{
+			LeaseID:       spec.Path + "/lease-2",
+			LeaseDuration: 3600,
+			Data:          map[string]interface{}{"password": "second"},
+		}
+	}
+
+	w, err := NewWatcher(client, time.Hour)
+	if err != nil {
+		t.Fatalf("could not create watcher: %v", err)
+	}
+
+	sec := secret.New("database/creds/app", &vaultApi.Secret{
+		LeaseID:       "database/creds/app/lease-1",
+		LeaseDuration: 3600,
+		Data:          map[string]interface{}{"password": "first"},
+	})
+
+	if err := w.replaceExpiredSecret(sec); err != nil {
+		t.Fatalf("unexpected error replacing expired secret: %v", err)
+	}
+
+	if sec.Data["password"] != "second" || sec.LeaseID != "database/creds/app/lease-2" {
+		t.Errorf("expected secret to be replaced by the new lease, got: %s %v", sec.LeaseID, sec.Data)
+	}
+
+	if len(w.expired) != 0 {
+		t.Errorf("expected no expired secrets to be left for retry, got: %d", len(w.expired))
+	}
+
+	if revoked := client.Revoked(); len(revoked) != 0 {
+		t.Errorf("expected previous lease to be kept during the grace period, got: %v", revoked)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(client.Revoked()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if revoked := client.Revoked(); len(revoked) != 1 || revoked[0] != "database/creds/app/lease-1" {
+		t.Errorf("expected previous lease to be revoked after the grace period, got: %v", revoked)
+	}
+}
+
+func TestCheckSecretsReissuesDueCertificate(t *testing.T) {
+	cfg := vaultclient.NewConfigWithDefaults()
+	cfg.PKIRenewFraction = 0.5
+
+	// Every fetch issues a fresh certificate
+	client := dummy.NewFake(cfg)
+	client.Issue = func(spec *secret.Spec) *vaultApi.Secret {
+		return &vaultApi.Secret{
+			Data: map[string]interface{}{
+				"certificate": vaulttest.IssueCertificate(t, time.Now(), time.Now().Add(time.Hour)),
+				"private_key": "key",
+			},
+		}
+	}
+
+	w, err := NewWatcher(client, time.Hour)
+	if err != nil {
+		t.Fatalf("could not create watcher: %v", err)
+	}
+
+	spec, err := secret.ParseSpec("POST:pki/issue/web?common_name=web.example.com")
+	if err != nil {
+		t.Fatalf("could not parse spec: %v", err)
+	}
+
+	issued := vaulttest.IssueCertificate(t, time.Now().Add(-2*time.Hour), time.Now().Add(time.Hour))
+	sec := secret.NewFromSpec(spec, &vaultApi.Secret{
+		Data: map[string]interface{}{"certificate": issued, "private_key": "key"},
+	})
+
+	updated, err := w.checkSecrets([]*secret.Secret{sec})
+	if err != nil {
+		t.Fatalf("unexpected error checking secrets: %v", err)
+	}
+
+	if !updated || len(client.Fetched()) != 1 || sec.Data["certificate"] == issued {
+		t.Errorf("expected due certificate to be issued again, got updated: %v, fetched: %d", updated, len(client.Fetched()))
+	}
+
+	updated, err = w.checkSecrets([]*secret.Secret{sec})
+	if err != nil {
+		t.Fatalf("unexpected error checking secrets: %v", err)
+	}
+
+	if updated || len(client.Fetched()) != 1 {
+		t.Errorf("expected fresh certificate not to be issued again, got updated: %v, fetched: %d", updated, len(client.Fetched()))
+	}
+}
+
+func TestCheckSecretsReissuesDueLeasedCertificate(t *testing.T) {
+	cfg := vaultclient.NewConfigWithDefaults()
+	cfg.LeaseRevokeGrace = 10 * time.Millisecond
+	cfg.PKIRenewFraction = 0.5
+
+	// PKI roles that do not set no_store issue certificates with a lease,
+	// whose renewal does not extend the certificate
+	client := dummy.NewFake(cfg)
+	client.Issue = func(spec *secret.Spec) *vaultApi.Secret {
+		return &vaultApi.Secret{
+			LeaseID:       "pki/issue/web/lease-2",
+			LeaseDuration: 3600,
+			Data: map[string]interface{}{
+				"certificate": vaulttest.IssueCertificate(t, time.Now(), time.Now().Add(time.Hour)),
+				"private_key": "key",
+			},
+		}
+	}
+
+	w, err := NewWatcher(client, time.Hour)
+	if err != nil {
+		t.Fatalf("could not create watcher: %v", err)
+	}
+
+	spec, err := secret.ParseSpec("POST:pki/issue/web?common_name=web.example.com")
+	if err != nil {
+		t.Fatalf("could not parse spec: %v", err)
+	}
+
+	issued := vaulttest.IssueCertificate(t, time.Now().Add(-2*time.Hour), time.Now().Add(time.Hour))
+	sec := secret.NewFromSpec(spec, &vaultApi.Secret{
+		LeaseID:       "pki/issue/web/lease-1",
+		LeaseDuration: 3600,
+		Data:          map[string]interface{}{"certificate": issued, "private_key": "key"},
+	})
+
+	updated, err := w.checkSecrets([]*secret.Secret{sec})
+	if err != nil {
+		t.Fatalf("unexpected error checking secrets: %v", err)
+	}
+
+	if !updated || len(client.Fetched()) != 1 || sec.Data["certificate"] == issued || sec.LeaseID != "pki/issue/web/lease-2" {
+		t.Errorf("expected due leased certificate to be issued again, got updated: %v, fetched: %d, lease: %s", updated, len(client.Fetched()), sec.LeaseID)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(client.Revoked()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if revoked := client.Revoked(); len(revoked) != 1 || revoked[0] != "pki/issue/web/lease-1" {
+		t.Errorf("expected the previous certificate's lease to be revoked, got: %v", revoked)
+	}
+}
+
+func TestSyncPaths(t *testing.T) {
+	cfg := vaultclient.NewConfigWithDefaults()
+	client := dummy.NewFake(cfg)
+	client.Issue = func(spec *secret.Spec) *vaultApi.Secret {
+		return &vaultApi.Secret{
+			Data: map[string]interface{}{"name": spec.Path},
+		}
+	}
+
+	w, err := NewWatcher(client, time.Hour)
+	if err != nil {
+		t.Fatalf("could not create watcher: %v", err)
+	}
+
+	api, _ := client.FetchSecret("secret/services/api")
+	web, _ := client.FetchSecret("secret/services/web")
+	secrets := []*secret.Secret{api, web}
+
+	cfg.Paths = []string{"secret/services/api", "secret/services/web"}
+	synced, changed, err := w.syncPaths(secrets)
+	if err != nil {
+		t.Fatalf("unexpected error syncing paths: %v", err)
+	}
+
+	if changed || len(synced) != 2 {
+		t.Errorf("expected unchanged paths to keep the secrets, got changed: %v, secrets: %d", changed, len(synced))
+	}
+
+	cfg.Paths = []string{"secret/services/api", "secret/services/worker"}
+	synced, changed, err = w.syncPaths(synced)
+	if err != nil {
+		t.Fatalf("unexpected error syncing paths: %v", err)
+	}
+
+	if !changed || len(synced) != 2 || synced[0] != api || synced[1].Path != "secret/services/worker" {
+		t.Errorf("expected removed path to be dropped and new path to be added, got changed: %v, secrets: %v", changed, synced)
+	}
+}